@@ -38,6 +38,7 @@ io.sockets.on('connection', function(socket) {
                         message.from = message.to;
                         message.to = tmp;
                         message.type = "error";
+                        message.code = "device_offline";
                         message.msg = "该设备失联，请稍后重试";
                         socket.emit("messageToBrowser", message);
                 }
@@ -57,6 +58,7 @@ io.sockets.on('connection', function(socket) {
                     }else {
                         socket.emit("messageToBrowser", {
                             type: "error",
+                            code: "device_offline",
                             from: data.to,
                             to: data.from,
                             msg: "服务失联，请稍后重试",
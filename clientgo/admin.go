@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"clientgo/signal"
+	"clientgo/simulcast"
+	"clientgo/wish"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+var (
+	// 管理接口的 token 文件, 为空时不提供管理接口
+	adminTokenFile = flag.String("admin-token-file", "", "file holding the bearer token of the admin API, the admin API is disabled if empty")
+	adminToken     []byte
+)
+
+// adminSession 管理接口列出的会话, 每个 track 的统计见 /stats
+type adminSession struct {
+	ClientID      string        `json:"clientId"`
+	Action        signal.Action `json:"action"`
+	Stream        string        `json:"stream,omitempty"`
+	Started       time.Time     `json:"started"`
+	ICEState      string        `json:"iceState"`
+	BytesReceived uint64        `json:"bytesReceived"`
+	BytesSent     uint64        `json:"bytesSent"`
+	// Recording 正在保存的文件
+	Recording string `json:"recording,omitempty"`
+}
+
+// adminStream 管理接口列出的直播流
+type adminStream struct {
+	Name string `json:"name"`
+	// Publisher 推流的客户端, 推流端断开后为空
+	Publisher   string            `json:"publisher,omitempty"`
+	Layers      []adminLayer      `json:"layers"`
+	Subscribers []adminSubscriber `json:"subscribers"`
+}
+
+type adminLayer struct {
+	Quality string `json:"quality"`
+	Bitrate int    `json:"bitrate"`
+}
+
+// adminSubscriber 拉流端, Layer 为正在转发的 simulcast 层, Mode 见 viewerMode
+type adminSubscriber struct {
+	ClientID string `json:"clientId"`
+	Layer    string `json:"layer"`
+	Mode     string `json:"mode"`
+}
+
+// loadAdminToken 读取管理接口的 token, 文件为空时返回错误
+func loadAdminToken(path string) error {
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	adminToken = []byte(strings.TrimSpace(string(token)))
+	if len(adminToken) == 0 {
+		return errors.New("admin token file " + path + " is empty")
+	}
+	return nil
+}
+
+// requireAdmin 请求需要带管理接口的 token, /admin/、/stats 和 /metrics 共用
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := []byte(wish.BearerToken(r))
+		if subtle.ConstantTimeCompare(token, adminToken) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, signal.NewError(signal.CodeUnauthorized, "invalid admin token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveAdmin 管理接口, 请求需要带 Authorization: Bearer token
+//
+//	GET    /admin/sessions                 列出会话
+//	DELETE /admin/sessions/{id}            关闭会话
+//	DELETE /admin/sessions/{id}/recording  停止保存推流
+//	GET    /admin/streams                  列出直播流和拉流端
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions" && r.Method == http.MethodGet:
+		writeAdminJSON(w, struct {
+			Sessions []adminSession `json:"sessions"`
+		}{listSessions()})
+	case len(parts) == 2 && parts[0] == "sessions" && r.Method == http.MethodDelete:
+		if !hangUp(parts[1], "closed by admin") {
+			writeAdminError(w, http.StatusNotFound, signal.NewError(signal.CodeSessionNotFound, "session not found"))
+			return
+		}
+		logger.Info("管理接口关闭会话", "client", parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "recording" && r.Method == http.MethodDelete:
+		if !stopRecording(parts[1]) {
+			writeAdminError(w, http.StatusNotFound, signal.NewError(signal.CodeSessionNotFound, "session is not recording"))
+			return
+		}
+		logger.Info("管理接口停止保存推流", "client", parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] == "streams" && r.Method == http.MethodGet:
+		writeAdminJSON(w, struct {
+			Streams []adminStream `json:"streams"`
+		}{listStreams()})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listSessions 所有会话, 按客户端 ID 排序
+func listSessions() []adminSession {
+	list := []adminSession{}
+	for _, s := range collectStats() {
+		list = append(list, adminSession{
+			ClientID:      s.ClientID,
+			Action:        s.Action,
+			Stream:        s.Stream,
+			Started:       s.Started,
+			ICEState:      s.ICEState,
+			BytesReceived: s.BytesReceived,
+			BytesSent:     s.BytesSent,
+			Recording:     recordingFile(s.ClientID),
+		})
+	}
+	return list
+}
+
+// listStreams 所有直播流, 按名称排序
+func listStreams() []adminStream {
+	streamsLock.Lock()
+	all := make([]*stream, 0, len(streams))
+	for _, s := range streams {
+		all = append(all, s)
+	}
+	streamsLock.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	list := make([]adminStream, 0, len(all))
+	for _, s := range all {
+		info := adminStream{Name: s.name, Layers: []adminLayer{}, Subscribers: []adminSubscriber{}}
+		s.mu.Lock()
+		publisher := s.publisher
+		layers := make([]*layer, 0, len(s.layers))
+		for _, l := range s.layers {
+			layers = append(layers, l)
+		}
+		viewers := s.viewerList()
+		s.mu.Unlock()
+
+		if publisher != nil && publisher.ICEConnectionState() != webrtc.ICEConnectionStateClosed {
+			info.Publisher = clientOf(publisher)
+		}
+		sort.Slice(layers, func(i, j int) bool { return simulcast.Rank(layers[i].quality) < simulcast.Rank(layers[j].quality) })
+		for _, l := range layers {
+			info.Layers = append(info.Layers, adminLayer{Quality: l.quality, Bitrate: l.Bitrate()})
+		}
+		for _, v := range viewers {
+			current, mode := v.status()
+			info.Subscribers = append(info.Subscribers, adminSubscriber{ClientID: v.clientID, Layer: current, Mode: mode.String()})
+		}
+		sort.Slice(info.Subscribers, func(i, j int) bool { return info.Subscribers[i].ClientID < info.Subscribers[j].ClientID })
+		list = append(list, info)
+	}
+	return list
+}
+
+// hangUp 关闭客户端的会话, 通过 channel 信令服务连接的客户端收到 bye 消息, msg 为 reason. 会话不存在时返回 false
+func hangUp(clientID, reason string) bool {
+	notify := channelSession(clientID)
+	if !closePeerConnection(clientID) {
+		return false
+	}
+	if notify {
+		client.Emit("messageToBrowser", signal.Message{Type: "bye", From: mac, To: clientID, Msg: reason})
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError 错误和 REST 信令相同, 为带 code 的 error 消息
+func writeAdminError(w http.ResponseWriter, status int, err *signal.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(signal.ErrorMessage(mac, "", err))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"clientgo/auth"
+	"clientgo/signal"
+	"clientgo/wish"
+)
+
+var (
+	// authSigner 校验客户端的 token, 没有配置密钥时为 nil, 不校验
+	authSigner *auth.Signer
+
+	// grants 客户端建立连接时使用的 token, 后续的 messageToDevice 必须携带同一个 token
+	grants     = make(map[string]string)
+	grantsLock sync.Mutex
+
+	// actionPermissions askToConnect 的动作需要的权限
+	actionPermissions = map[signal.Action]auth.Permission{
+		signal.ActionPushToFileAndStream: auth.PermPush,
+		signal.ActionPushToRTMP:          auth.PermPush,
+		signal.ActionPullFromStream:      auth.PermPullLive,
+		signal.ActionPullFromFile:        auth.PermPullFile,
+	}
+
+	errUnknownAction = errors.New("unknown action")
+)
+
+// loadAuthKey 读取签名密钥, 文件为空时返回错误
+func loadAuthKey(path string) error {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) == 0 {
+		return errors.New("auth key file " + path + " is empty")
+	}
+	authSigner = auth.NewSigner(key)
+	return nil
+}
+
+// authorizeConnect 在创建连接之前校验 askToConnect 的 token 是否允许这个动作.
+// 会话创建后再用 storeGrant 记录 token
+func authorizeConnect(msg signal.Message, action signal.Action) error {
+	if authSigner == nil {
+		return nil
+	}
+	perm, ok := actionPermissions[action]
+	if !ok {
+		return errUnknownAction
+	}
+	_, err := authSigner.Authorize(msg.Token, mac, msg.From, perm)
+	return err
+}
+
+// storeGrant 记录新建会话的 token, 客户端已经有 token 时不覆盖, 返回 auth.ErrForbidden
+func storeGrant(clientID, token string) error {
+	if authSigner == nil {
+		return nil
+	}
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+	if _, ok := grants[clientID]; ok {
+		return auth.ErrForbidden
+	}
+	grants[clientID] = token
+	return nil
+}
+
+// authorizeMessage 校验 messageToDevice 携带的是建立连接时的 token, 并且没有过期
+func authorizeMessage(msg signal.Message) error {
+	if authSigner == nil {
+		return nil
+	}
+	grantsLock.Lock()
+	grant := grants[msg.From]
+	grantsLock.Unlock()
+	if grant == "" || msg.Token != grant {
+		return auth.ErrForbidden
+	}
+	_, err := authSigner.Verify(msg.Token)
+	return err
+}
+
+// authorizeTracks 校验重新协商添加的 track 在会话 token 的权限内, 直播流需要 pull-live, 文件需要 pull-file.
+// 推流会话添加的接收 track 已经由动作的 push 权限允许
+func authorizeTracks(clientID string, tracks []signal.Track) error {
+	if authSigner == nil {
+		return nil
+	}
+	grantsLock.Lock()
+	grant := grants[clientID]
+	grantsLock.Unlock()
+	claims, err := authSigner.Verify(grant)
+	if err != nil {
+		return err
+	}
+	for _, t := range tracks {
+		switch {
+		case t.Stream != "" && !claims.Allows(auth.PermPullLive):
+			return signal.NewError(signal.CodeForbidden, "token does not allow pulling stream "+t.Stream)
+		case t.File != "" && !claims.Allows(auth.PermPullFile):
+			return signal.NewError(signal.CodeForbidden, "token does not allow playing file "+t.File)
+		}
+	}
+	return nil
+}
+
+// revokeGrant 连接关闭后删除客户端的 token
+func revokeGrant(clientID string) {
+	grantsLock.Lock()
+	delete(grants, clientID)
+	grantsLock.Unlock()
+}
+
+// authorizeBearer 校验 WHIP/WHEP 请求的 Bearer token
+func authorizeBearer(r *http.Request, perm auth.Permission) error {
+	if authSigner == nil {
+		return nil
+	}
+	if _, err := authSigner.Authorize(wish.BearerToken(r), mac, "", perm); err != nil {
+		return wish.ErrUnauthorized
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package auth signs and verifies the tokens browsers attach to signaling
+// messages.
+//
+// Tokens are JWTs signed with HMAC-SHA256 (HS256) using a key shared by
+// the issuer and the device. The claims name the device the token is
+// valid for, what the holder may do there and when the token expires.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Permission is an action a token allows on a device
+type Permission string
+
+// Permissions checked by the device before creating a PeerConnection
+const (
+	PermPush     Permission = "push"
+	PermPullLive Permission = "pull-live"
+	PermPullFile Permission = "pull-file"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed tokens and bad signatures
+	ErrInvalidToken = errors.New("auth: invalid token")
+
+	// ErrExpired is returned for tokens past their expiry
+	ErrExpired = errors.New("auth: token expired")
+
+	// ErrWrongDevice is returned when a token was issued for another device
+	ErrWrongDevice = errors.New("auth: token not valid for this device")
+
+	// ErrForbidden is returned when a token lacks a permission
+	ErrForbidden = errors.New("auth: permission denied")
+)
+
+// Claims is the payload of a token
+//
+//	Subject    the client the token was issued to, any client if empty
+//	Device     the device id (mac) the token is valid for
+//	Perms      the permissions granted on the device
+//	ExpiresAt  unix time after which the token is rejected
+//	IssuedAt   unix time the token was signed
+type Claims struct {
+	Subject   string       `json:"sub,omitempty"`
+	Device    string       `json:"dev"`
+	Perms     []Permission `json:"perms"`
+	ExpiresAt int64        `json:"exp"`
+	IssuedAt  int64        `json:"iat,omitempty"`
+}
+
+// Allows reports whether the claims grant perm
+func (c *Claims) Allows(perm Permission) bool {
+	for _, p := range c.Perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// header is the JOSE header of the tokens we sign
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// joseHeader is decoded from tokens, any algorithm other than HS256 is
+// rejected instead of being verified differently
+type joseHeader struct {
+	Alg string `json:"alg"`
+}
+
+// Signer signs and verifies tokens with one key
+type Signer struct {
+	key []byte
+}
+
+// NewSigner builds a Signer using key, which should be at least 32
+// random bytes
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Sign returns the token for claims, IssuedAt is filled if zero
+func (s *Signer) Sign(claims Claims) (string, error) {
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + s.signature(signingInput), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims
+func (s *Signer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h joseHeader
+	if err = json.Unmarshal(rawHeader, &h); err != nil || h.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	expected := s.signature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// Authorize verifies token and checks that it grants perm on device to
+// client
+func (s *Signer) Authorize(token, device, client string, perm Permission) (*Claims, error) {
+	claims, err := s.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Device != device {
+		return nil, ErrWrongDevice
+	}
+	if claims.Subject != "" && claims.Subject != client {
+		return nil, ErrForbidden
+	}
+	if !claims.Allows(perm) {
+		return nil, ErrForbidden
+	}
+	return claims, nil
+}
+
+func (s *Signer) signature(signingInput string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
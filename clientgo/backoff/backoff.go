@@ -0,0 +1,93 @@
+// Package backoff computes the delays between retries of a failing
+// operation, like connecting to the signaling server.
+//
+// Delays grow exponentially from a minimum up to a maximum. Each delay is
+// randomly shortened by up to a fraction of itself, so devices that lost
+// the same server do not all come back at the same moment.
+package backoff
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFactor doubles the delay after every failure
+	DefaultFactor = 2.0
+
+	// DefaultJitter shortens a delay by up to half of it
+	DefaultJitter = 0.5
+)
+
+// Backoff is the retry state of one operation. It is safe for concurrent
+// use.
+type Backoff struct {
+	min, max time.Duration
+	factor   float64
+	jitter   float64
+
+	mu      sync.Mutex
+	attempt int
+	rand    *rand.Rand
+}
+
+// New returns a Backoff starting at min and growing up to max with the
+// default factor and jitter
+func New(min, max time.Duration) *Backoff {
+	return NewWithJitter(min, max, DefaultFactor, DefaultJitter)
+}
+
+// NewWithJitter returns a Backoff multiplying the delay by factor after
+// every failure, each delay is shortened by a random fraction of it up to
+// jitter, between 0 and 1
+func NewWithJitter(min, max time.Duration, factor, jitter float64) *Backoff {
+	if max < min {
+		max = min
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return &Backoff{
+		min:    min,
+		max:    max,
+		factor: factor,
+		jitter: jitter,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the delay before the next retry and counts a failure
+func (b *Backoff) Next() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delay := float64(b.min)
+	for i := 0; i < b.attempt && delay < float64(b.max); i++ {
+		delay *= b.factor
+	}
+	if delay > float64(b.max) {
+		delay = float64(b.max)
+	}
+	b.attempt++
+	delay -= delay * b.jitter * b.rand.Float64()
+	return time.Duration(delay)
+}
+
+// Attempt returns the number of failures since the last Reset
+func (b *Backoff) Attempt() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempt
+}
+
+// Reset starts again from the minimum delay, after the operation succeeded
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt = 0
+}
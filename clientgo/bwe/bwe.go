@@ -0,0 +1,188 @@
+// Package bwe estimates the bandwidth available to a publisher from the
+// RTP packets the device receives, so it can be sent back as REMB.
+//
+// The estimator follows the shape of Google congestion control on the
+// receive side. A delay based detector looks at how much later frames
+// arrive than their RTP timestamps say they were sent, a loss based
+// controller looks at sequence number gaps. The estimate drops below the
+// incoming rate on overuse or heavy loss, and slowly grows otherwise.
+package bwe
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// overuseThreshold is the queueing delay, in milliseconds, above which
+	// the link is considered overused
+	overuseThreshold = 25.0
+
+	// queueDecay slowly forgets the queueing delay, so clock drift between
+	// the publisher and the device does not add up to a false overuse
+	queueDecay = 0.995
+
+	// decreaseFactor is applied to the incoming rate on overuse
+	decreaseFactor = 0.85
+
+	// increaseFactor is applied to the estimate every update without loss
+	increaseFactor = 1.08
+
+	// maxIncomingRatio caps the estimate to a multiple of the incoming
+	// rate, the publisher must be able to use what it is allowed to send
+	maxIncomingRatio = 1.5
+)
+
+// Estimator estimates the receive bandwidth of one connection. It is safe
+// for concurrent use, every track of the connection feeds it.
+type Estimator struct {
+	mu       sync.Mutex
+	min, max float64
+	estimate float64
+	streams  map[uint32]*streamState
+
+	bytes       int
+	windowStart time.Time
+}
+
+// streamState is the state of one SSRC
+type streamState struct {
+	clockRate float64
+
+	started     bool
+	lastSeq     uint16
+	received    int
+	expected    int
+	lastTS      uint32
+	lastArrival time.Time
+	queue       float64
+}
+
+// NewEstimator returns an Estimator starting at initial bps, the estimate
+// stays between min and max bps
+func NewEstimator(initial, min, max int) *Estimator {
+	if initial > max {
+		initial = max
+	}
+	return &Estimator{
+		min:         float64(min),
+		max:         float64(max),
+		estimate:    float64(initial),
+		streams:     make(map[uint32]*streamState),
+		windowStart: time.Now(),
+	}
+}
+
+// SetMax changes the upper bound of the estimate
+func (e *Estimator) SetMax(max int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.max = float64(max)
+	if e.estimate > e.max {
+		e.estimate = e.max
+	}
+}
+
+// OnPacket records a packet of size bytes received at arrival. clockRate
+// is the RTP clock rate of the codec.
+func (e *Estimator) OnPacket(arrival time.Time, ssrc uint32, seq uint16, timestamp uint32, clockRate uint32, size int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bytes += size
+
+	s := e.streams[ssrc]
+	if s == nil {
+		s = &streamState{clockRate: float64(clockRate)}
+		e.streams[ssrc] = s
+	}
+	if !s.started {
+		s.started = true
+		s.lastSeq = seq
+		s.lastTS = timestamp
+		s.lastArrival = arrival
+		s.received, s.expected = 1, 1
+		return
+	}
+
+	// int16 handles wrap around, late and duplicate packets are not gaps
+	if diff := int16(seq - s.lastSeq); diff > 0 {
+		s.expected += int(diff)
+		s.lastSeq = seq
+	}
+	s.received++
+
+	// Packets of a frame share the timestamp, the delay is measured once
+	// per frame on its first packet
+	if timestamp == s.lastTS || s.clockRate == 0 {
+		return
+	}
+	if int32(timestamp-s.lastTS) < 0 {
+		// reordered frame
+		return
+	}
+	sent := float64(timestamp-s.lastTS) / s.clockRate * 1000
+	received := float64(arrival.Sub(s.lastArrival)) / float64(time.Millisecond)
+	s.queue = s.queue*queueDecay + received - sent
+	if s.queue < 0 {
+		s.queue = 0
+	}
+	s.lastTS = timestamp
+	s.lastArrival = arrival
+}
+
+// Update computes a new estimate from the packets received since the last
+// update and returns it in bps. It is called periodically, about once a
+// second.
+func (e *Estimator) Update(now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	elapsed := now.Sub(e.windowStart).Seconds()
+	if elapsed <= 0 || e.bytes == 0 {
+		return int(e.estimate)
+	}
+	incoming := float64(e.bytes*8) / elapsed
+	e.bytes = 0
+	e.windowStart = now
+
+	overuse := false
+	received, expected := 0, 0
+	for _, s := range e.streams {
+		if s.queue > overuseThreshold {
+			overuse = true
+		}
+		received += s.received
+		expected += s.expected
+		s.received, s.expected = 0, 0
+	}
+	loss := 0.0
+	if expected > 0 && received < expected {
+		loss = float64(expected-received) / float64(expected)
+	}
+
+	switch {
+	case overuse:
+		e.estimate = incoming * decreaseFactor
+	case loss > 0.1:
+		e.estimate = e.estimate * (1 - 0.5*loss)
+	case loss < 0.02:
+		e.estimate = e.estimate * increaseFactor
+		if limit := incoming * maxIncomingRatio; e.estimate > limit {
+			e.estimate = limit
+		}
+	}
+	if e.estimate < e.min {
+		e.estimate = e.min
+	}
+	if e.estimate > e.max {
+		e.estimate = e.max
+	}
+	return int(e.estimate)
+}
+
+// Forget removes the state of ssrc, when its track has ended
+func (e *Estimator) Forget(ssrc uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.streams, ssrc)
+}
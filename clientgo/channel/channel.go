@@ -0,0 +1,68 @@
+// Package channel is a Go implementation of the channel signaling service
+// (channel/webrtc-channel.js) over plain WebSockets.
+//
+// Devices join the room named by their id with createOrJoin. Browsers ask
+// a device to connect with canConnect, which the server relays to the room
+// as askToConnect, then exchange offers, answers and candidates through
+// messageToDevice and messageToBrowser. Every connection is also reachable
+// by its own id, like a socket.io socket.
+//
+// Each WebSocket message is one JSON encoded Frame.
+package channel
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Events relayed by the server, named after the socket.io events
+const (
+	EventConnect          = "connect"
+	EventCreateOrJoin     = "createOrJoin"
+	EventCreated          = "created"
+	EventCanConnect       = "canConnect"
+	EventAskToConnect     = "askToConnect"
+	EventMessageToDevice  = "messageToDevice"
+	EventMessageToBrowser = "messageToBrowser"
+	EventLog              = "log"
+	EventBye              = "bye"
+)
+
+const (
+	// writeWait bounds the time to write a frame to the peer
+	writeWait = 10 * time.Second
+
+	// pongWait is the time allowed to read the next pong from the peer
+	pongWait = 60 * time.Second
+
+	// pingPeriod must be less than pongWait
+	pingPeriod = pongWait * 9 / 10
+
+	// maxFrameSize bounds a single frame, offers are a few KB
+	maxFrameSize = 1 << 20
+
+	// sendBufferSize is the number of frames queued for a slow connection
+	// before it is dropped
+	sendBufferSize = 64
+)
+
+// Frame is the JSON envelope of every WebSocket message
+//
+//	Event  the socket.io event name
+//	Data   the event argument
+//	ID     set by the sender when it expects an acknowledgement
+//	Ack    set on the acknowledgement of the frame with the same ID
+type Frame struct {
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	ID    uint64          `json:"id,omitempty"`
+	Ack   uint64          `json:"ack,omitempty"`
+}
+
+func newFrame(event string, data interface{}) (Frame, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Event: event, Data: b}, nil
+}
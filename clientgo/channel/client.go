@@ -0,0 +1,129 @@
+package channel
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned by Emit after the connection closed
+var ErrClosed = errors.New("channel: connection closed")
+
+// Client is a connection to a Server, used by devices and by Go programs
+// acting as a browser. Handlers run one at a time on the read goroutine.
+type Client struct {
+	ws *websocket.Conn
+
+	mu           sync.Mutex
+	id           string
+	handlers     map[string]func(json.RawMessage)
+	onDisconnect func(error)
+
+	writeMu sync.Mutex
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Dial connects to the Server at url, e.g. ws://127.0.0.1:10900/ws.
+// Register handlers with On and start reading with Run.
+func Dial(url string) (*Client, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		ws:       ws,
+		handlers: make(map[string]func(json.RawMessage)),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// ID returns the id the Server assigned to this connection, it is empty
+// until the connect event is received
+func (c *Client) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// On registers the handler of an event, it replaces any previous handler
+func (c *Client) On(event string, handler func(data json.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[event] = handler
+}
+
+// OnDisconnect registers a function called once when the connection is lost
+func (c *Client) OnDisconnect(f func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onDisconnect = f
+}
+
+// Emit sends an event with args encoded as JSON
+func (c *Client) Emit(event string, args interface{}) error {
+	f, err := newFrame(event, args)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteJSON(f)
+}
+
+// Run reads frames and dispatches them to the handlers until the
+// connection is lost or closed
+func (c *Client) Run() {
+	c.ws.SetReadLimit(maxFrameSize)
+	var err error
+	for {
+		var f Frame
+		if err = c.ws.ReadJSON(&f); err != nil {
+			break
+		}
+		if f.Event == EventConnect {
+			var id string
+			json.Unmarshal(f.Data, &id)
+			c.mu.Lock()
+			c.id = id
+			c.mu.Unlock()
+		}
+		c.mu.Lock()
+		handler := c.handlers[f.Event]
+		c.mu.Unlock()
+		if handler != nil {
+			handler(f.Data)
+		}
+	}
+
+	c.Close()
+	c.mu.Lock()
+	onDisconnect := c.onDisconnect
+	c.mu.Unlock()
+	if onDisconnect != nil {
+		onDisconnect(err)
+	}
+}
+
+// Close closes the connection, Run returns after it
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		c.writeMu.Lock()
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+		c.writeMu.Unlock()
+		err = c.ws.Close()
+	})
+	return err
+}
@@ -0,0 +1,255 @@
+package channel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"clientgo/signal"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server relays signaling between devices and browsers, it is a
+// http.Handler accepting WebSocket upgrades
+type Server struct {
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	conns map[string]*conn
+	rooms map[string]map[*conn]struct{}
+}
+
+// NewServer builds an empty Server
+func NewServer() *Server {
+	return &Server{
+		upgrader: websocket.Upgrader{
+			// Browsers load the page from another origin, same as socket.io
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(map[string]*conn),
+		rooms: make(map[string]map[*conn]struct{}),
+	}
+}
+
+// conn is a WebSocket connected to the Server
+type conn struct {
+	id     string
+	ws     *websocket.Conn
+	send   chan Frame
+	closed chan struct{}
+	once   sync.Once
+}
+
+// ServeHTTP upgrades the request and serves the connection until it closes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("channel: upgrade failed:", err)
+		return
+	}
+	id, err := newConnID()
+	if err != nil {
+		ws.Close()
+		return
+	}
+	c := &conn{
+		id:     id,
+		ws:     ws,
+		send:   make(chan Frame, sendBufferSize),
+		closed: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.conns[id] = c
+	s.mu.Unlock()
+
+	go c.writePump()
+	s.emit(c, EventConnect, id)
+	s.readPump(c)
+	s.remove(c)
+}
+
+// Rooms returns the number of connections in every room
+func (s *Server) Rooms() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := make(map[string]int, len(s.rooms))
+	for name, members := range s.rooms {
+		rooms[name] = len(members)
+	}
+	return rooms
+}
+
+func (s *Server) readPump(c *conn) {
+	c.ws.SetReadLimit(maxFrameSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		var f Frame
+		if err := c.ws.ReadJSON(&f); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("channel:", c.id, "read failed:", err)
+			}
+			return
+		}
+		s.dispatch(c, f)
+	}
+}
+
+func (c *conn) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+	for {
+		select {
+		case f := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteJSON(f); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.closed:
+			c.ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// dispatch handles a frame the same way webrtc-channel.js handles the event
+func (s *Server) dispatch(c *conn, f Frame) {
+	switch f.Event {
+	case EventMessageToBrowser:
+		var msg signal.Message
+		if json.Unmarshal(f.Data, &msg) != nil {
+			return
+		}
+		s.mu.Lock()
+		to := s.conns[msg.To]
+		s.mu.Unlock()
+		if to != nil && to != c {
+			to.queue(Frame{Event: EventMessageToBrowser, Data: f.Data})
+		}
+
+	case EventMessageToDevice:
+		var msg signal.Message
+		if json.Unmarshal(f.Data, &msg) != nil {
+			return
+		}
+		if !s.toRoom(msg.To, Frame{Event: EventMessageToDevice, Data: f.Data}) {
+			s.emit(c, EventMessageToBrowser, signal.ErrorMessage(msg.To, msg.From,
+				signal.NewError(signal.CodeDeviceOffline, "该设备失联，请稍后重试")))
+		}
+
+	case EventCanConnect:
+		var msg signal.Message
+		if json.Unmarshal(f.Data, &msg) != nil {
+			return
+		}
+		if s.toRoom(msg.To, Frame{Event: EventAskToConnect, Data: f.Data}) {
+			return
+		}
+		if f.ID != 0 {
+			b, _ := json.Marshal("Error: 服务失联，请稍后再试")
+			c.queue(Frame{Ack: f.ID, Data: b})
+			return
+		}
+		s.emit(c, EventMessageToBrowser, signal.ErrorMessage(msg.To, msg.From,
+			signal.NewError(signal.CodeDeviceOffline, "服务失联，请稍后重试")))
+
+	case EventCreateOrJoin:
+		var room string
+		if json.Unmarshal(f.Data, &room) != nil || room == "" {
+			return
+		}
+		s.emit(c, EventLog, []string{"log from server:", "Received request to create " + room})
+		s.join(c, room)
+		s.emit(c, EventCreated, room)
+
+	case EventBye:
+		log.Println("channel: received bye from", c.id)
+	}
+}
+
+// toRoom queues f on every connection in room, it returns false when the
+// room is empty
+func (s *Server) toRoom(room string, f Frame) bool {
+	s.mu.Lock()
+	members := make([]*conn, 0, len(s.rooms[room]))
+	for member := range s.rooms[room] {
+		members = append(members, member)
+	}
+	s.mu.Unlock()
+	for _, member := range members {
+		member.queue(f)
+	}
+	return len(members) > 0
+}
+
+func (s *Server) join(c *conn, room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rooms[room] == nil {
+		s.rooms[room] = make(map[*conn]struct{})
+	}
+	s.rooms[room][c] = struct{}{}
+}
+
+func (s *Server) remove(c *conn) {
+	s.mu.Lock()
+	delete(s.conns, c.id)
+	for name, members := range s.rooms {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(s.rooms, name)
+		}
+	}
+	s.mu.Unlock()
+	c.close()
+}
+
+func (s *Server) emit(c *conn, event string, data interface{}) {
+	f, err := newFrame(event, data)
+	if err != nil {
+		log.Println("channel: encode", event, "failed:", err)
+		return
+	}
+	c.queue(f)
+}
+
+// queue sends f without blocking, a connection that does not keep up is
+// closed
+func (c *conn) queue(f Frame) {
+	select {
+	case c.send <- f:
+	case <-c.closed:
+	default:
+		log.Println("channel:", c.id, "send buffer full, closing")
+		c.close()
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func newConnID() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
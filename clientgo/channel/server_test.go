@@ -0,0 +1,183 @@
+package channel
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clientgo/signal"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a Client recording the events it receives
+type testClient struct {
+	*Client
+	events chan Frame
+}
+
+func dialTest(t *testing.T, url string) *testClient {
+	c, err := Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testClient{Client: c, events: make(chan Frame, 16)}
+	for _, event := range []string{EventConnect, EventCreated, EventAskToConnect, EventMessageToDevice, EventMessageToBrowser} {
+		event := event
+		c.On(event, func(data json.RawMessage) {
+			tc.events <- Frame{Event: event, Data: data}
+		})
+	}
+	go c.Run()
+	tc.expect(t, EventConnect)
+	return tc
+}
+
+// expect returns the data of the next event, it fails the test when the
+// next event is another one or none arrives
+func (c *testClient) expect(t *testing.T, event string) json.RawMessage {
+	t.Helper()
+	select {
+	case f := <-c.events:
+		if f.Event != event {
+			t.Fatalf("received %s %s, want %s", f.Event, f.Data, event)
+		}
+		return f.Data
+	case <-time.After(time.Second):
+		t.Fatalf("no %s received", event)
+	}
+	return nil
+}
+
+// expectMessage is expect for the events carrying a signal.Message
+func (c *testClient) expectMessage(t *testing.T, event string) signal.Message {
+	t.Helper()
+	var msg signal.Message
+	if err := json.Unmarshal(c.expect(t, event), &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func (c *testClient) emit(t *testing.T, event string, args interface{}) {
+	t.Helper()
+	if err := c.Emit(event, args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startTestServer(t *testing.T) (*Server, string, func()) {
+	s := NewServer()
+	srv := httptest.NewServer(s)
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http"), srv.Close
+}
+
+// waitRoom waits until room has n connections
+func waitRoom(t *testing.T, s *Server, room string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.Rooms()[room] != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("room %s has %d connections, want %d", room, s.Rooms()[room], n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerRouting(t *testing.T) {
+	s, url, stop := startTestServer(t)
+	defer stop()
+
+	device := dialTest(t, url)
+	defer device.Close()
+	device.emit(t, EventCreateOrJoin, "dev1")
+	var room string
+	json.Unmarshal(device.expect(t, EventCreated), &room)
+	if room != "dev1" {
+		t.Errorf("created %q, want dev1", room)
+	}
+	waitRoom(t, s, "dev1", 1)
+
+	browser1 := dialTest(t, url)
+	defer browser1.Close()
+	browser2 := dialTest(t, url)
+	defer browser2.Close()
+
+	// canConnect is relayed to the room as askToConnect
+	browser1.emit(t, EventCanConnect, signal.Message{From: browser1.ID(), To: "dev1", Type: "pull"})
+	if msg := device.expectMessage(t, EventAskToConnect); msg.From != browser1.ID() || msg.Type != "pull" {
+		t.Errorf("device asked to connect by %+v", msg)
+	}
+
+	browser2.emit(t, EventMessageToDevice, signal.Message{From: browser2.ID(), To: "dev1", Type: "offer", Sdp: "v=0"})
+	if msg := device.expectMessage(t, EventMessageToDevice); msg.From != browser2.ID() || msg.Sdp != "v=0" {
+		t.Errorf("device received %+v", msg)
+	}
+
+	// messageToBrowser only reaches the browser it is sent to
+	device.emit(t, EventMessageToBrowser, signal.Message{From: "dev1", To: browser2.ID(), Type: "answer"})
+	device.emit(t, EventMessageToBrowser, signal.Message{From: "dev1", To: browser1.ID(), Type: "candidate"})
+	if msg := browser2.expectMessage(t, EventMessageToBrowser); msg.Type != "answer" {
+		t.Errorf("browser2 received %+v", msg)
+	}
+	if msg := browser1.expectMessage(t, EventMessageToBrowser); msg.Type != "candidate" {
+		t.Errorf("browser1 received %+v", msg)
+	}
+
+	// a browser leaving does not affect the others
+	browser2.Close()
+	device.emit(t, EventMessageToBrowser, signal.Message{From: "dev1", To: browser2.ID(), Type: "candidate"})
+	browser1.emit(t, EventMessageToDevice, signal.Message{From: browser1.ID(), To: "dev1", Type: "candidate"})
+	if msg := device.expectMessage(t, EventMessageToDevice); msg.From != browser1.ID() {
+		t.Errorf("device received %+v", msg)
+	}
+
+	// the room is removed with the device, browsers are told it is offline
+	device.Close()
+	waitRoom(t, s, "dev1", 0)
+	if _, ok := s.Rooms()["dev1"]; ok {
+		t.Errorf("empty room kept")
+	}
+	browser1.emit(t, EventCanConnect, signal.Message{From: browser1.ID(), To: "dev1"})
+	if msg := browser1.expectMessage(t, EventMessageToBrowser); msg.Type != "error" || msg.Code != signal.CodeDeviceOffline || msg.To != browser1.ID() {
+		t.Errorf("canConnect to an offline device answered %+v", msg)
+	}
+	browser1.emit(t, EventMessageToDevice, signal.Message{From: browser1.ID(), To: "dev1", Type: "offer"})
+	if msg := browser1.expectMessage(t, EventMessageToBrowser); msg.Type != "error" || msg.Code != signal.CodeDeviceOffline {
+		t.Errorf("messageToDevice to an offline device answered %+v", msg)
+	}
+}
+
+// canConnect with an acknowledgement id is answered with an ack when the
+// device is offline, like the socket.io callback
+func TestServerCanConnectAck(t *testing.T) {
+	_, url, stop := startTestServer(t)
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var f Frame
+	if err := ws.ReadJSON(&f); err != nil || f.Event != EventConnect {
+		t.Fatalf("first frame %+v, %v", f, err)
+	}
+
+	data, _ := json.Marshal(signal.Message{To: "dev1"})
+	if err := ws.WriteJSON(Frame{Event: EventCanConnect, Data: data, ID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	f = Frame{}
+	if err := ws.ReadJSON(&f); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	json.Unmarshal(f.Data, &reply)
+	if f.Ack != 7 || !strings.HasPrefix(reply, "Error:") {
+		t.Errorf("canConnect answered %+v", f)
+	}
+}
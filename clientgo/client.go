@@ -1,11 +1,9 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"log"
 	"math/rand"
 	"os"
 	"runtime"
@@ -14,42 +12,21 @@ import (
 
 	gosocketio "github.com/graarh/golang-socketio"
 
-	gst "clientgo/gstreamer-sink"
 	"clientgo/ivfreader"
 	"clientgo/ivfwriter"
+	"clientgo/logging"
+	"clientgo/signal"
+	"clientgo/simulcast"
 
 	"github.com/graarh/golang-socketio/transport"
-	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	webrtc "github.com/pion/webrtc/v2"
 	media "github.com/pion/webrtc/v2/pkg/media"
 )
 
-//Message 客户端发送和接收的信息格式
-//
-//  From 客户端的socket.ID
-//  To  server的Mac 地址
-//  Sdp  base64 编码的sdp, 需要加密
-//  Type  消息的类型
-//  Msg  当消息类型为错误的时候，附带的信息
-//  Candidate  candidate 验证参数
-//  SDPMid  candidate 验证参数
-//  SDPMLineIndex  candidate 验证参数
-//  UsernameFragment  candidate 验证参数
-type Message struct {
-	From             string `json:"from"`
-	To               string `json:"to"`
-	Sdp              string `json:"sdp"`
-	Type             string `json:"type"`
-	Msg              string `json:"msg"`
-	Candidate        string `json:"candidate"`
-	SDPMid           string `json:"sdpMid"`
-	SDPMLineIndex    uint16 `json:"sdpMLineIndex"`
-	UsernameFragment string `json:"usernameFragment"`
-}
-
 var (
-	client             *gosocketio.Client
+	client             signalingClient
 	webURL             = gosocketio.GetUrl("127.0.0.1", 10900, false)
 	websocketTransport = &transport.WebsocketTransport{
 		PingInterval:   10 * time.Second,
@@ -58,8 +35,6 @@ var (
 		SendTimeout:    30 * time.Second,
 		BufferSize:     1024 * 32,
 	}
-	err    error
-	pcs    = make(map[string]*webrtc.PeerConnection)
 	config = webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			// {
@@ -71,290 +46,436 @@ var (
 		},
 	}
 	// 服务器ID
-	mac             = "123"
-	pcsLock         sync.Mutex
-	createRoomTimer *time.Timer
-	m               = webrtc.MediaEngine{}
-	api             *webrtc.API
-	localTrack      *webrtc.Track
-	firstPush       bool
+	mac = "123"
+	m   = webrtc.MediaEngine{}
+	api *webrtc.API
+	// WHIP/WHEP 服务地址
+	httpAddr = flag.String("http", ":8080", "WHIP/WHEP http server address")
+	// 原生 WebSocket 信令服务 (cmd/channel) 地址, 为空时使用 socket.io 连接 channel 服务
+	signalWS = flag.String("signal-ws", "", "native WebSocket signaling url, e.g. ws://127.0.0.1:10900/ws, socket.io is used if empty")
+	// REST 信令服务, 地址为空时不启动
+	signalHTTPAddr    = flag.String("signal-http", "", "REST signaling server address, disabled if empty")
+	signalHTTPPrefix  = flag.String("signal-prefix", "/signal", "REST signaling path prefix")
+	signalHTTPCert    = flag.String("signal-cert", "", "REST signaling TLS certificate file")
+	signalHTTPKey     = flag.String("signal-key", "", "REST signaling TLS key file")
+	signalHTTPTimeout = flag.Duration("signal-timeout", signal.DefaultHTTPTimeout, "REST signaling request timeout")
+	// token 签名密钥文件, 为空时不校验客户端的 token
+	authKeyFile = flag.String("auth-key-file", "", "file holding the HMAC key of client tokens, tokens are not checked if empty")
+	// 信令加密: 为空不加密, psk 使用 -seal-key-file 的共享密钥, ecdh 每个客户端首次连接时协商密钥
+	sealMode    = flag.String("seal", "", "seal sdp and candidates end to end: psk or ecdh, disabled if empty")
+	sealKeyFile = flag.String("seal-key-file", "", "file holding the secret shared with browsers in psk seal mode")
+
+	// errSessionExists 客户端已经有会话时再次 askToConnect
+	errSessionExists = signal.NewError(signal.CodeSessionExists, "session already exists, close it first")
 )
 
 const (
 	videoClockRate = 90000
 	audioClockRate = 48000
+	// rtpOutboundMTU 和 pion/webrtc 打包时的 MTU 相同
+	rtpOutboundMTU = 1200
 )
 
-func createOrJoinRoom() {
-	client.Emit("createOrJoin", mac)
-	createRoomTimer = time.AfterFunc(time.Second*3, createOrJoinRoom)
+// signalingClient 设备和信令服务之间的连接, socket.io 或原生 WebSocket
+type signalingClient interface {
+	Emit(method string, args interface{}) error
 }
 
-//连接socketio 信令服务器
-func connect() {
-	client, err = gosocketio.Dial(webURL, websocketTransport)
+// dialSocketIO 连接 socket.io 信令服务器 (channel 目录的 node 服务), 事件交给 link 处理
+func dialSocketIO(url string, l *signalingLink) (signalingConn, error) {
+	sio, err := gosocketio.Dial(url, websocketTransport)
 	if err != nil {
-		log.Println("链接", webURL, "失败, 请先启动channel服务, 2 秒后重连")
-		// 连接失败后， 间隔一段时间后再次重连
-		time.AfterFunc(time.Second*2, connect)
-		return
+		return nil, err
 	}
-	client.On(gosocketio.OnDisconnection, func(h *gosocketio.Channel) {
-		log.Println("Disconnected")
-		// 停止创建房间
-		createRoomTimer.Stop()
-		connect()
+	sio.On(gosocketio.OnDisconnection, func(h *gosocketio.Channel) {
+		l.onDisconnected(nil)
 	})
-	client.On(gosocketio.OnError, func(err error) {
-		log.Println("Webrtc gosocketio has err:", err)
+	sio.On(gosocketio.OnError, func(err error) {
+		logger.Error("socket.io 出错", "error", err)
 
 	})
-	client.On(gosocketio.OnConnection, func(h *gosocketio.Channel) {
-		log.Println("Connected")
-		// 创建房间， 失败后一段时间自动重新创建。
-		createOrJoinRoom()
+	sio.On(gosocketio.OnConnection, func(h *gosocketio.Channel) {
+		l.onConnected(h)
 	})
-	client.On("log", func(h *gosocketio.Channel, args []string) {
+	sio.On("log", func(h *gosocketio.Channel, args []string) {
 		//log.Println("log from server:", strings.Join(args, " "))
 	})
 	//建立连接后初始化通道控制
-	client.On("created", func(h *gosocketio.Channel, room string) {
-		log.Println("created room ", room)
-		// 停止创建房间
-		createRoomTimer.Stop()
-
+	sio.On("created", func(h *gosocketio.Channel, room string) {
+		l.onCreated(room)
 	})
 	// 客户端请求建立连接
-	client.On("askToConnect", func(h *gosocketio.Channel, msg Message) {
-		err := createPeerConnection(msg.From, msg.Msg)
+	sio.On("askToConnect", func(h *gosocketio.Channel, msg signal.Message) {
+		l.onAskToConnect(msg)
+	})
+	sio.On("messageToDevice", func(h *gosocketio.Channel, msg signal.Message) {
+		l.onMessageToDevice(msg)
+	})
+	return socketIOConn{sio}, nil
+}
+
+// socketIOConn gosocketio.Client 的 Close 没有返回值
+type socketIOConn struct {
+	*gosocketio.Client
+}
+
+func (c socketIOConn) Close() error {
+	c.Client.Close()
+	return nil
+}
+
+// handleConnect 处理客户端建立连接的请求, 返回 ready 或 error 消息. channel 为请求是否来自 channel 信令服务
+func handleConnect(msg signal.Message, channel bool) signal.Message {
+	if isShuttingDown() {
+		return replyError(msg, signal.NewError(signal.CodeDeviceOffline, errShuttingDown.Error()))
+	}
+	req, err := signal.ParseConnectRequest(msg.Msg)
+	if err != nil {
+		return replyError(msg, err)
+	}
+	if err := authorizeConnect(msg, req.Action); err != nil {
+		return replyError(msg, err)
+	}
+	// 已有会话时不协商新的密钥, 信令服务冒充客户端重复发送 askToConnect 不能替换会话的密钥
+	if peers.peerConnection(msg.From) != nil {
+		return replyError(msg, errSessionExists)
+	}
+	ready := signal.Message{
+		Type: "ready",
+		To:   msg.From,
+		From: msg.To,
+		Msg:  "OK",
+	}
+	key, err := negotiateSeal(msg, &ready)
+	if err != nil {
+		return replyError(msg, err)
+	}
+	created, err := createPeerConnection(msg.From, req, channel)
+	if err != nil {
+		return replyError(msg, err)
+	}
+	if !created {
+		// 同时到达的另一个 askToConnect 已经创建了会话, 不能在已经协商的 pc 上生成 offer
+		return replyError(msg, errSessionExists)
+	}
+	// 会话创建后才记录 token 和密钥, 创建失败时不留下, 已有会话的不被覆盖
+	if err := storeGrant(msg.From, msg.Token); err != nil {
+		closePeerConnection(msg.From)
+		return replyError(msg, err)
+	}
+	storeSealKey(msg.From, key)
+	if req.DeviceOffer {
+		if err := offerToClient(msg.From, &ready); err != nil {
+			closePeerConnection(msg.From)
+			return replyError(msg, err)
+		}
+	}
+	return ready
+}
+
+// offerToClient 拉流会话由设备生成 offer 放在 ready 消息中, 设备决定发送的 track 和编码
+func offerToClient(clientID string, ready *signal.Message) error {
+	pc := peers.peerConnection(clientID)
+	if pc == nil {
+		return signal.NewError(signal.CodeSessionNotFound, "session closed")
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	key, err := sealKey(clientID)
+	if err != nil {
+		return err
+	}
+	ready.Sdp, err = signal.EncodeWith(key, offer, ready.AAD("sdp"))
+	return err
+}
+
+// handleMessage 处理客户端发来的 offer, answer, candidate 和 renegotiate
+//
+// offer 回复 answer 或 error 消息, renegotiate 回复设备的 offer 或 error 消息,
+// answer 和 candidate 出错时回复 error 消息
+//
+// 重新协商时客户端的 answer 和 candidate 发给重新协商中的 pc, 见 session
+func handleMessage(msg signal.Message) (reply *signal.Message) {
+	pc, sess := peers.get(msg.From)
+	if pc == nil {
+		if msg.Type == "offer" || msg.Type == "answer" || msg.Type == "renegotiate" {
+			errReply := replyError(msg, signal.NewError(signal.CodeSessionNotFound, "askToConnect first"))
+			return &errReply
+		}
+		return nil
+	}
+	if err := authorizeMessage(msg); err != nil {
+		errReply := replyError(msg, err)
+		return &errReply
+	}
+	key, err := sealKey(msg.From)
+	if err != nil {
+		errReply := replyError(msg, err)
+		return &errReply
+	}
+	switch msg.Type {
+	case "offer":
+		defer func() {
+			if e := recover(); e != nil {
+				errReply := replyError(msg, signal.NewError(signal.CodeInternal, fmt.Sprintf("run time panic: %v", e)))
+				reply = &errReply
+			}
+		}()
+		offer := webrtc.SessionDescription{}
+		if err = signal.DecodeWith(key, msg.Sdp, msg.AAD("sdp"), &offer); err != nil {
+			errReply := replyError(msg, codedError(err, signal.CodeBadSDP))
+			return &errReply
+		}
+		var answer webrtc.SessionDescription
+		if sess != nil && pc.RemoteDescription() != nil {
+			// 客户端发起的重新协商
+			answer, err = sess.acceptOffer(offer)
+		} else {
+			answer, err = answerOffer(pc, offer)
+		}
 		if err != nil {
-			client.Emit("messageToBrowser", Message{
-				Type: "error",
-				To:   msg.From,
-				From: msg.To,
-				Msg:  err.Error(),
-			})
-			return
+			errReply := replyError(msg, codedError(err, signal.CodeBadSDP))
+			return &errReply
 		}
-		client.Emit("messageToBrowser", Message{
-			Type: "ready",
+		reply = &signal.Message{
+			Type: "answer",
 			To:   msg.From,
 			From: msg.To,
-			Msg:  "OK",
+		}
+		if reply.Sdp, err = signal.EncodeWith(key, answer, reply.AAD("sdp")); err != nil {
+			errReply := replyError(msg, err)
+			return &errReply
+		}
+		return reply
+	case "renegotiate":
+		if sess == nil {
+			errReply := replyError(msg, signal.NewError(signal.CodeSessionNotFound, "session can not be renegotiated"))
+			return &errReply
+		}
+		r, err := signal.ParseRenegotiation(msg.Msg, sess.req.Action)
+		if err != nil {
+			errReply := replyError(msg, err)
+			return &errReply
+		}
+		if err := authorizeTracks(msg.From, r.Add); err != nil {
+			errReply := replyError(msg, err)
+			return &errReply
+		}
+		offer, tracks, err := sess.renegotiate(r)
+		if err != nil {
+			errReply := replyError(msg, err)
+			return &errReply
+		}
+		return deviceOffer(msg, key, offer, tracks)
+	case "answer":
+		answer := webrtc.SessionDescription{}
+		if err = signal.DecodeWith(key, msg.Sdp, msg.AAD("sdp"), &answer); err != nil {
+			errReply := replyError(msg, codedError(err, signal.CodeBadSDP))
+			return &errReply
+		}
+		target := pc
+		if sess != nil && sess.pendingPeerConnection() != nil {
+			target = sess.pendingPeerConnection()
+		}
+		if err = target.SetRemoteDescription(answer); err != nil {
+			errReply := replyError(msg, codedError(err, signal.CodeBadSDP))
+			return &errReply
+		}
+	case "candidate":
+		candidate, err := openCandidate(key, msg)
+		if err != nil {
+			errReply := replyError(msg, codedError(err, signal.CodeBadCandidate))
+			return &errReply
+		}
+		target := pc
+		if sess != nil && sess.pendingPeerConnection() != nil {
+			target = sess.pendingPeerConnection()
+		}
+		err = target.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate:        candidate,
+			SDPMid:           &msg.SDPMid,
+			SDPMLineIndex:    &msg.SDPMLineIndex,
+			UsernameFragment: msg.UsernameFragment,
 		})
+		if err != nil {
+			errReply := replyError(msg, codedError(err, signal.CodeBadCandidate))
+			return &errReply
+		}
+	}
+	return nil
+}
 
-	})
-	client.On("messageToDevice", func(h *gosocketio.Channel, msg Message) {
-		pcsLock.Lock()
-		pc := pcs[msg.From]
-		pcsLock.Unlock()
-		if pc != nil {
-			if msg.Type == "offer" {
-				offer := webrtc.SessionDescription{}
-				tmpbyte, err := base64.StdEncoding.DecodeString(msg.Sdp)
-				defer func() {
-					if e := recover(); e != nil {
-						client.Emit("messageToBrowser", Message{
-							Type: "error",
-							To:   msg.From,
-							From: msg.To,
-							Msg:  fmt.Sprintf("run time panic: %v", e),
-						})
-						return
-					}
-				}()
-				if err != nil {
-					client.Emit("messageToBrowser", Message{
-						Type: "error",
-						To:   msg.From,
-						From: msg.To,
-						Msg:  err.Error(),
-					})
-					return
-				}
-				json.Unmarshal(tmpbyte, &offer)
-				err = pc.SetRemoteDescription(offer)
-				if err != nil {
-					client.Emit("messageToBrowser", Message{
-						Type: "error",
-						To:   msg.From,
-						From: msg.To,
-						Msg:  err.Error(),
-					})
-					return
-				}
-				answer, err := pc.CreateAnswer(nil)
-				if err != nil {
-					client.Emit("messageToBrowser", Message{
-						Type: "error",
-						To:   msg.From,
-						From: msg.To,
-						Msg:  err.Error(),
-					})
-					return
-				}
-				err = pc.SetLocalDescription(answer)
-				if err != nil {
-					client.Emit("messageToBrowser", Message{
-						Type: "error",
-						To:   msg.From,
-						From: msg.To,
-						Msg:  err.Error(),
-					})
-					return
-				}
-				tmpbyte, err = json.Marshal(answer)
-				if err != nil {
-					client.Emit("messageToBrowser", Message{
-						Type: "error",
-						To:   msg.From,
-						From: msg.To,
-						Msg:  err.Error(),
-					})
-					return
-				}
-				client.Emit("messageToBrowser", Message{
-					Type: "answer",
-					To:   msg.From,
-					From: msg.To,
-					Sdp:  base64.StdEncoding.EncodeToString(tmpbyte),
-				})
-			} else if msg.Type == "candidate" {
-				pc.AddICECandidate(webrtc.ICECandidateInit{
-					Candidate:        msg.Candidate,
-					SDPMid:           &msg.SDPMid,
-					SDPMLineIndex:    &msg.SDPMLineIndex,
-					UsernameFragment: msg.UsernameFragment,
-				})
-			}
+// deviceOffer 设备发给客户端的 offer, Msg 为会话的所有 track
+func deviceOffer(msg signal.Message, key *signal.Key, offer webrtc.SessionDescription, tracks []signal.Track) *signal.Message {
+	reply := &signal.Message{
+		Type: "offer",
+		To:   msg.From,
+		From: msg.To,
+	}
+	b, err := json.Marshal(tracks)
+	if err != nil {
+		errReply := replyError(msg, err)
+		return &errReply
+	}
+	reply.Msg = string(b)
+	if reply.Sdp, err = signal.EncodeWith(key, offer, reply.AAD("sdp")); err != nil {
+		errReply := replyError(msg, err)
+		return &errReply
+	}
+	return reply
+}
+
+// replyError 回复给发送 msg 的客户端的错误消息, 错误码见 errorCodes
+func replyError(msg signal.Message, err error) signal.Message {
+	return signal.ErrorMessage(msg.To, msg.From, codedError(err, signal.CodeInternal))
+}
+
+// defaultCodecs 没有指定编码时协商的编码, 和 pion/webrtc 的 RegisterDefaultCodecs 顺序相同
+var defaultCodecs = []string{webrtc.Opus, webrtc.G722, webrtc.VP8, webrtc.H264, webrtc.VP9}
+
+// sessionAPI 只协商客户端请求的编码, 没有指定编码时使用所有默认编码, 视频编码支持 REMB. 断开检测见 iceSettings
+func sessionAPI(req *signal.ConnectRequest) *webrtc.API {
+	me := webrtc.MediaEngine{}
+	codecs := req.Codecs
+	if len(codecs) == 0 {
+		codecs = defaultCodecs
+	}
+	for _, codec := range codecs {
+		switch codec {
+		case webrtc.VP8:
+			me.RegisterCodec(withREMB(webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, videoClockRate)))
+		case webrtc.VP9:
+			me.RegisterCodec(withREMB(webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, videoClockRate)))
+		case webrtc.H264:
+			me.RegisterCodec(withREMB(webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, videoClockRate)))
+		case webrtc.Opus:
+			me.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, audioClockRate))
+		case webrtc.G722:
+			me.RegisterCodec(webrtc.NewRTPG722Codec(webrtc.DefaultPayloadTypeG722, 8000))
 		}
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(iceSettings()))
+}
 
+// createPeerConnection 客户端没有会话时创建会话和 pc, 返回是否创建了新的会话. 超过资源上限时返回 limit_exceeded 错误
+func createPeerConnection(clientID string, req *signal.ConnectRequest, channel bool) (bool, error) {
+	sess := newSession(clientID, req)
+	sess.channel = channel
+	return peers.getOrCreate(clientID, usageOf(req.Action, sess.tracks), func() (*webrtc.PeerConnection, *session, error) {
+		peerConnection, err := sess.newPeerConnection(sess.tracks)
+		if err != nil {
+			sess.close()
+			return nil, nil, err
+		}
+		return peerConnection, sess, nil
 	})
 }
 
-func createPeerConnection(clientID string, action string) error {
-	if pcs[clientID] == nil {
-		// 创建 pc
-		peerConnection, err := webrtc.NewPeerConnection(config)
-		//peerConnection, err := api.NewPeerConnection(config)
-		if err != nil {
+// logICEState 记录连接状态的变化
+func logICEState(log *logging.Logger, connectionState webrtc.ICEConnectionState) {
+	if connectionState == webrtc.ICEConnectionStateFailed ||
+		connectionState == webrtc.ICEConnectionStateDisconnected {
+		log.Warn("客户端失去连接", "state", connectionState)
+		return
+	}
+	log.Info("连接状态变化", "state", connectionState)
+}
+
+// pushToFileAndStream 接收推流, record 时保存到 output-ID.ivf 文件, 同时分发给拉流名为 streamName 的客户端
+func pushToFileAndStream(peerConnection *webrtc.PeerConnection, clientID string, streamName string, record bool) error {
+	// Allow us to receive 1 audio track, and 1 video track
+	if err := receiveTracks(peerConnection, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	saveAndPublishTracks(peerConnection, clientID, streamName, record)
+	return nil
+}
+
+// receiveTracks 为每个 kind 添加一个接收推流的 transceiver
+func receiveTracks(peerConnection *webrtc.PeerConnection, kinds ...webrtc.RTPCodecType) error {
+	for _, kind := range kinds {
+		if _, err := peerConnection.AddTransceiver(kind); err != nil {
 			return err
 		}
-		peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-			fmt.Printf("Connection State has changed %s \n", connectionState.String())
-
-			if connectionState == webrtc.ICEConnectionStateConnected {
-				fmt.Println("Ctrl+C the remote client to stop the demo")
-			} else if connectionState == webrtc.ICEConnectionStateFailed ||
-				connectionState == webrtc.ICEConnectionStateDisconnected {
+	}
+	return nil
+}
 
-				fmt.Println("客户端", clientID, "---失去连接")
-				//os.Exit(0)
-			}
-		})
-		if action == "push to file and stream" {
-			// Allow us to receive 1 audio track, and 1 video track
-			if _, err = peerConnection.AddTransceiver(webrtc.RTPCodecTypeAudio); err != nil {
-				//	panic(err)
-			} else if _, err = peerConnection.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
-				//	panic(err)
+// saveAndPublishTracks 收到的 VP8 视频保存到文件并作为直播流 streamName 分发, opus 音频只分发
+func saveAndPublishTracks(peerConnection *webrtc.PeerConnection, clientID string, streamName string, record bool) {
+	feedback := newBandwidthFeedback(peerConnection, streamName)
+	peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		if !beginMediaTask() {
+			return
+		}
+		defer mediaTasks.Done()
+		defer recoverSession(peerConnection, clientID)
+		log := clientLogger(clientID, signal.ActionPushToFileAndStream).With("ssrc", track.SSRC())
+		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+		go requestKeyframes(peerConnection, track.SSRC(), log)
+		codec := track.Codec()
+		log.Info("开始接收 track", "payloadType", track.PayloadType(), "codec", codec.Name)
+		reader := newMeteredReader(peerConnection, track, feedback)
+		if codec.Name == webrtc.VP8 {
+			feedback.add(track.SSRC())
+			defer feedback.remove(track.SSRC())
+			// simulcast 的每一层是一个 track, 只保存最高的一层
+			quality := simulcastLayer(peerConnection, track.SSRC())
+			localTrack := publishStream(streamName, quality, peerConnection, track)
+			go readSenderReports(receiver, track.SSRC(), localTrack.onSenderReport)
+			if !record || quality != simulcast.High {
+				saveToDiskAndAddtoLocaltrack(discardWriter{}, reader, localTrack, log)
+				return
 			}
-			peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
-				// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-				go func() {
-					ticker := time.NewTicker(time.Second * 3)
-					for range ticker.C {
-						errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}})
-						if errSend != nil {
-							fmt.Println(errSend)
-						}
-					}
-				}()
-				if localTrack == nil {
-					localTrack, _ = peerConnection.NewTrack(track.PayloadType(), track.SSRC(), "video", "pion")
-				}
-				codec := track.Codec()
-				fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), codec.Name)
-				if codec.Name == webrtc.VP8 {
-					fmt.Println("Got VP8 track, saving to disk as output-" + clientID + ".ivf")
-					ivfFile, _ := ivfwriter.New("output-" + clientID + ".ivf")
-					saveToDiskAndAddtoLocaltrack(ivfFile, track)
-				}
-			})
-		}
-		if action == "push to rtmp" {
-			// Allow us to receive 1 audio track, and 2 video tracks
-			if _, err = peerConnection.AddTransceiver(webrtc.RTPCodecTypeAudio); err != nil {
-				panic(err)
-			} else if _, err = peerConnection.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
-				panic(err)
-			} else if _, err = peerConnection.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
-				panic(err)
+			if r := activeRecording(clientID); r != nil {
+				// ICE 重启或重新协商后继续保存到同一个文件, 管理接口停止保存后不再保存
+				log.Info("继续保存视频", "file", r.file)
+				saveToDiskAndAddtoLocaltrack(recordingTrack{r}, reader, localTrack, log)
+				return
 			}
-			peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
-				// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-				go func() {
-					ticker := time.NewTicker(time.Second * 3)
-					for range ticker.C {
-						errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}})
-						if errSend != nil {
-							fmt.Println(errSend)
-						}
-					}
-				}()
-				codec := track.Codec()
-				fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), codec.Name)
-				pipeline := gst.CreatePipeline(codec.Name)
-				pipeline.Start()
-				buf := make([]byte, 1400)
-				for {
-					i, readErr := track.Read(buf)
-					fmt.Println("-----", i)
-					if readErr != nil {
-						panic(err)
-					}
-
-					pipeline.Push(buf[:i])
-				}
-			})
-
-		}
-		if action == "pull from stream" {
+			output := outputFile(clientID)
+			log.Info("保存视频", "file", output)
+			ivfFile, err := ivfwriter.New(output)
 			if err != nil {
-				sendErrorToClient(err, clientID)
-			}
-			if localTrack != nil {
-				fmt.Println("pull from stream")
-				_, err = peerConnection.AddTrack(localTrack)
-				if err != nil {
-					fmt.Println("add pull stream error:", err)
-					sendErrorToClient(err, clientID)
-				}
+				log.Error("创建视频文件出错", "file", output, "error", err)
+				return
 			}
-
+			saveToDiskAndAddtoLocaltrack(recordingTrack{startRecording(clientID, output, ivfFile)}, reader, localTrack, log)
 		}
-		if action == "pull from file" {
-			fmt.Println("pull from file")
-			VideoTrack, err := peerConnection.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), mac, mac)
-			if err != nil {
-				sendErrorToClient(err, clientID)
-			}
-			go playVideo(VideoTrack)
-			_, err = peerConnection.AddTrack(VideoTrack)
-			if err != nil {
-				sendErrorToClient(err, clientID)
-			}
+		if codec.Name == webrtc.Opus {
+			// 音频只转发给拉流端, 不保存
+			feedback.add(track.SSRC())
+			defer feedback.remove(track.SSRC())
+			audio := publishAudio(streamName, peerConnection)
+			go readSenderReports(receiver, track.SSRC(), audio.onSenderReport)
+			saveToDiskAndAddtoLocaltrack(discardWriter{}, reader, audio, log)
+		}
+	})
+}
 
+// outputFile 推流保存的文件名, 同一个客户端再次推流时保存到新的文件
+func outputFile(clientID string) string {
+	name := "output-" + clientID + ".ivf"
+	for n := 1; ; n++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
 		}
-		pcsLock.Lock()
-		pcs[clientID] = peerConnection
-		pcsLock.Unlock()
-		return err
+		name = fmt.Sprintf("output-%s-%d.ivf", clientID, n)
 	}
-	return nil
 }
 
-func saveToDiskAndAddtoLocaltrack(i media.Writer, track *webrtc.Track) {
+// rtpWriter 接收转发的 RTP 包, 直播流的 layer 实现了这个接口
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// saveToDiskAndAddtoLocaltrack 读取推流端的 track, 保存到 i 并转发给 localTrack, debug 级别时记录每个包
+func saveToDiskAndAddtoLocaltrack(i media.Writer, track rtpReader, localTrack rtpWriter, log *logging.Logger) {
 	defer func() {
 		if err := i.Close(); err != nil {
 			//panic(err)
@@ -364,75 +485,164 @@ func saveToDiskAndAddtoLocaltrack(i media.Writer, track *webrtc.Track) {
 	rtpBuf := make([]byte, 8192)
 	for {
 		n, err := track.Read(rtpBuf)
-		fmt.Println("----", n)
 		if err != nil {
-			fmt.Println("读取视频帧数据Error", err)
-		}
-		// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-		if _, err := localTrack.Write(rtpBuf[:n]); err != nil && err != io.ErrClosedPipe {
-			//panic(err)
-			fmt.Println("流分发出错Error", err)
+			// 推流端断开, 结束保存
+			log.Info("推流端 track 结束", "error", err)
+			return
 		}
 		rtpPacket := &rtp.Packet{}
 		if err := rtpPacket.Unmarshal(rtpBuf[:n]); err != nil {
-			fmt.Println("解析视频数据Error", err)
+			log.Warn("解析 RTP 包出错", "error", err)
+			continue
+		}
+		if log.Enabled(logging.Debug) {
+			log.Debug("收到 RTP 包", "size", n, "seq", rtpPacket.SequenceNumber, "timestamp", rtpPacket.Timestamp)
 		}
-		// 保存视频文件
+		if err := localTrack.WriteRTP(rtpPacket); err != nil {
+			log.Warn("流分发出错", "error", err)
+		}
+		// 保存视频文件, 出错后停止保存, 继续分发直播流
 		if err := i.WriteRTP(rtpPacket); err != nil {
-			//panic(err)
-			fmt.Println("保存视频错误error", err)
+			log.Error("保存视频出错, 停止保存", "error", err)
 			i.Close()
-			fmt.Println("Done writing media files")
+			i = discardWriter{}
 		}
 	}
 }
 
+// discardWriter 不保存文件时丢弃收到的视频
+type discardWriter struct{}
+
+func (discardWriter) WriteRTP(*rtp.Packet) error { return nil }
+func (discardWriter) Close() error               { return nil }
+
 func addStream(peerConnection *webrtc.PeerConnection, clientID string) {
 	// 没有则先创建这个通道视频
-	VideoTrack, err := peerConnection.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), mac, mac)
-	if err != nil {
+	if err := pullFromFile(peerConnection, ""); err != nil {
 		sendErrorToClient(err, clientID)
 	}
-	go playVideo(VideoTrack)
-	_, err = peerConnection.AddTrack(VideoTrack)
+}
+
+// pullFromFile 播放保存的视频文件 ID.ivf, 没有指定文件时播放 test.ivf
+func pullFromFile(peerConnection *webrtc.PeerConnection, fileID string) error {
+	source, err := openFile(fileID)
 	if err != nil {
-		sendErrorToClient(err, clientID)
+		return err
 	}
+	sender, err := peerConnection.AddTrack(source.track)
+	if err != nil {
+		source.stop()
+		return err
+	}
+	addTrackStats(peerConnection, source.report.stats)
+	go playVideo(source)
+	go sendReports(peerConnection, source.report)
+	go readReceiverReports(sender, source.report)
+	return nil
 }
 
-func sendErrorToClient(err error, clientID string) {
-	client.Emit("messageToBrowser", Message{
-		Type: "error",
-		To:   clientID,
-		From: mac,
-		Msg:  err.Error(),
-	})
+// fileSource 播放中的视频文件, 重新协商时 track 添加到新的 pc, 继续播放
+type fileSource struct {
+	track  *webrtc.Track
+	file   *os.File
+	ivf    *ivfreader.IVFReader
+	header *ivfreader.IVFFileHeader
+	done   chan struct{}
+	once   sync.Once
+	// packetizer 自己打包才能知道每个包的时间戳, 用于生成 SR
+	packetizer rtp.Packetizer
+	report     *senderReporter
 }
 
-func playVideo(VideoTrack *webrtc.Track) {
+// openFile 打开视频文件 ID.ivf, 没有指定文件时打开 test.ivf
+func openFile(fileID string) (*fileSource, error) {
+	if fileID == "" {
+		fileID = "test"
+	}
 	// Open a IVF file and start reading using our IVFReader
-	file, ivfErr := os.Open("test.ivf")
-	if ivfErr != nil {
-		//panic(ivfErr)
+	file, err := os.Open(fileID + ".ivf")
+	if err != nil {
+		return nil, signal.NewError(signal.CodeFileNotFound, "file "+fileID+" not found")
+	}
+	ivf, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	VideoTrack, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), mac, mac,
+		webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, videoClockRate))
+	if err != nil {
+		file.Close()
+		return nil, err
 	}
+	return &fileSource{
+		track:  VideoTrack,
+		file:   file,
+		ivf:    ivf,
+		header: header,
+		done:   make(chan struct{}),
+		packetizer: rtp.NewPacketizer(rtpOutboundMTU, VideoTrack.PayloadType(), VideoTrack.SSRC(),
+			&codecs.VP8Payloader{}, rtp.NewRandomSequencer(), videoClockRate),
+		report: newSenderReporter(VideoTrack.SSRC(), signal.KindVideo, webrtc.VP8, videoClockRate),
+	}, nil
+}
 
-	ivf, header, ivfErr := ivfreader.NewWith(file)
-	if ivfErr != nil {
-		//panic(ivfErr)
+// stop 停止播放并关闭文件
+func (f *fileSource) stop() {
+	f.once.Do(func() {
+		close(f.done)
+		f.file.Close()
+	})
+}
+
+// sendErrorToClient 连接建立后的错误主动发送给客户端, 错误码见 errorCodes.
+// WHIP/WHEP 和 REST 的客户端不能接收设备主动发送的消息, 不发送
+func sendErrorToClient(err error, clientID string) {
+	if channelSession(clientID) {
+		emitError(err, clientID)
 	}
+}
+
+// emitError 通过 channel 信令服务发送错误消息, 调用方需要确认客户端的会话通过 channel 建立
+func emitError(err error, clientID string) {
+	client.Emit("messageToBrowser", signal.ErrorMessage(mac, clientID, codedError(err, signal.CodeInternal)))
+}
+
+// channelSession 客户端是否有通过 channel 信令服务建立的会话, 只有这样的客户端能收到设备主动发送的消息
+func channelSession(clientID string) bool {
+	s := peers.session(clientID)
+	return s != nil && s.channel
+}
+
+func playVideo(source *fileSource) {
+	defer source.stop()
+	VideoTrack, ivf, header := source.track, source.ivf, source.header
 
 	// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
 	// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
 	sleepTime := time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
+	// 每一帧的时间戳间隔
+	samples := uint32(sleepTime.Seconds() * videoClockRate)
+	// ticker 不会累积每一帧的处理时间, 发送速度和时间戳一致
+	ticker := time.NewTicker(sleepTime)
+	defer ticker.Stop()
 	for {
 		frame, _, ivfErr := ivf.ParseNextFrame()
 		if ivfErr != nil {
-			//panic(ivfErr)
+			// 文件播放结束
+			return
 		}
 
-		time.Sleep(sleepTime)
-		if ivfErr = VideoTrack.WriteSample(media.Sample{Data: frame, Samples: 90000}); ivfErr != nil {
-			//panic(ivfErr)
+		select {
+		case <-ticker.C:
+		case <-source.done:
+			return
+		}
+		for _, packet := range source.packetizer.Packetize(frame, samples) {
+			if ivfErr = VideoTrack.WriteRTP(packet); ivfErr != nil {
+				break
+			}
+			source.report.onPacket(packet, localMapping(packet, videoClockRate))
 		}
 	}
 }
@@ -444,6 +654,34 @@ func init() {
 }
 
 func main() {
+	flag.Parse()
+	if err := setupLogger(); err != nil {
+		logger.Fatal("日志配置错误", "error", err)
+	}
+	if *authKeyFile != "" {
+		if err := loadAuthKey(*authKeyFile); err != nil {
+			logger.Fatal("读取 token 密钥失败", "error", err)
+		}
+	}
+	if *adminTokenFile != "" {
+		if err := loadAdminToken(*adminTokenFile); err != nil {
+			logger.Fatal("读取管理接口 token 失败", "error", err)
+		}
+	}
+	if *gstTemplateFile != "" {
+		if err := loadGSTTemplates(*gstTemplateFile); err != nil {
+			logger.Fatal("gstreamer 管道模板错误", "error", err)
+		}
+	}
+	switch *sealMode {
+	case "", sealECDH:
+	case sealPSK:
+		if err := loadSealKey(*sealKeyFile); err != nil {
+			logger.Fatal("读取加密密钥失败", "error", err)
+		}
+	default:
+		logger.Fatal("不支持的加密模式", "seal", *sealMode)
+	}
 
 	// Setup the codecs you want to use.
 	// We'll use a VP8 codec but you can also define your own
@@ -453,12 +691,24 @@ func main() {
 	// Create the API object with the MediaEngine
 	api = webrtc.NewAPI(webrtc.WithMediaEngine(m))
 	// 启动wertc
-	if true {
-		connect()
+	var signaling *reconnector
+	if *signalWS != "" {
+		signaling = newReconnector(*signalWS, dialWS)
+	} else {
+		signaling = newReconnector(webURL, dialSocketIO)
+	}
+	client = signaling
+	signaling.connect()
+	if *statsInterval > 0 {
+		go pushStats(*statsInterval)
+	}
+	go serveHTTP(*httpAddr)
+	if *signalHTTPAddr != "" {
+		serveSignalHTTP()
 	}
 
 	//gst.StartMainLoop()
 
-	select {}
+	waitForShutdown()
 
 }
@@ -0,0 +1,28 @@
+// Command channel runs the signaling service in Go, it replaces
+// channel/webrtc-channel.js for devices and browsers speaking plain
+// WebSockets.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"clientgo/channel"
+)
+
+func main() {
+	addr := flag.String("addr", ":10900", "listen address")
+	path := flag.String("path", "/ws", "WebSocket path")
+	static := flag.String("static", "", "directory of static files to serve, disabled if empty")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.Handle(*path, channel.NewServer())
+	if *static != "" {
+		mux.Handle("/", http.FileServer(http.Dir(*static)))
+	}
+
+	log.Println("now server started at", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
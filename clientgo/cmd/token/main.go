@@ -0,0 +1,54 @@
+// Command token issues the tokens browsers attach to canConnect and
+// messageToDevice, and WHIP/WHEP clients send as bearer tokens.
+//
+//	token -key-file key -device 123 -perms push,pull-live -ttl 1h
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"clientgo/auth"
+)
+
+func main() {
+	keyFile := flag.String("key-file", "", "file holding the HMAC key shared with the device")
+	device := flag.String("device", "", "device id (mac) the token is valid for")
+	perms := flag.String("perms", "pull-live", "comma separated permissions: push, pull-live, pull-file")
+	subject := flag.String("sub", "", "client id the token is bound to, any client if empty")
+	ttl := flag.Duration("ttl", time.Hour, "token lifetime")
+	flag.Parse()
+
+	if *keyFile == "" || *device == "" {
+		flag.Usage()
+		log.Fatal("-key-file and -device are required")
+	}
+	key, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	claims := auth.Claims{
+		Subject:   *subject,
+		Device:    *device,
+		ExpiresAt: time.Now().Add(*ttl).Unix(),
+	}
+	for _, p := range strings.Split(*perms, ",") {
+		switch perm := auth.Permission(strings.TrimSpace(p)); perm {
+		case auth.PermPush, auth.PermPullLive, auth.PermPullFile:
+			claims.Perms = append(claims.Perms, perm)
+		default:
+			log.Fatalf("unknown permission %q", p)
+		}
+	}
+
+	token, err := auth.NewSigner([]byte(strings.TrimSpace(string(key)))).Sign(claims)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"clientgo/auth"
+	"clientgo/signal"
+	"clientgo/simulcast"
+)
+
+// errorCodes 内部错误对应的错误码, 不在表里的错误使用调用方指定的错误码
+//
+//	auth.ErrInvalidToken, auth.ErrExpired        unauthorized
+//	auth.ErrWrongDevice, auth.ErrForbidden       forbidden
+//	errUnknownAction                             invalid_action
+//	errStreamNotFound                            stream_not_found
+//	errMissingPublicKey, errNoSealKey            seal_failed
+//	simulcast.ErrRIDUnsupported, ErrTooManyLayers  unsupported
+//	signal.ErrSealed, ErrNotSealed, ErrTampered  seal_failed
+//	解析或应用 offer 的其他错误                  bad_sdp
+//	解析或添加 candidate 的其他错误              bad_candidate
+//	其他错误                                     internal
+var errorCodes = map[error]signal.Code{
+	auth.ErrInvalidToken: signal.CodeUnauthorized,
+	auth.ErrExpired:      signal.CodeUnauthorized,
+	auth.ErrWrongDevice:  signal.CodeForbidden,
+	auth.ErrForbidden:    signal.CodeForbidden,
+	errUnknownAction:     signal.CodeInvalidAction,
+	errStreamNotFound:    signal.CodeStreamNotFound,
+	errMissingPublicKey:  signal.CodeSealFailed,
+	errNoSealKey:         signal.CodeSealFailed,
+
+	simulcast.ErrRIDUnsupported: signal.CodeUnsupported,
+	simulcast.ErrTooManyLayers:  signal.CodeUnsupported,
+}
+
+// codedError 返回带错误码的错误, 没有对应错误码时使用 fallback
+func codedError(err error, fallback signal.Code) *signal.Error {
+	if code, ok := errorCodes[err]; ok {
+		return signal.NewError(code, err.Error())
+	}
+	return signal.WithCode(fallback, err)
+}
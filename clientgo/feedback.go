@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"clientgo/bwe"
+	"clientgo/stats"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+const (
+	// 推流端码率的下限和初始值, bps
+	minPublishBitrate     = 100 * 1000
+	initialPublishBitrate = 1000 * 1000
+	// rembInterval 发送 REMB 的间隔
+	rembInterval = time.Second
+)
+
+var (
+	// 推流端的码率上限, kbps, -stream-bitrate 可以按流名称单独设置
+	publishBitrate = flag.Int("publish-bitrate", 2500, "default upper bound of a publisher's bitrate in kbps, sent as REMB")
+	streamBitrates = bitrateCaps{}
+)
+
+func init() {
+	flag.Var(streamBitrates, "stream-bitrate", "upper bound of a stream's publisher bitrate as name=kbps, may be repeated")
+}
+
+// bitrateCaps 每个直播流的码率上限, kbps
+type bitrateCaps map[string]int
+
+func (c bitrateCaps) String() string {
+	caps := make([]string, 0, len(c))
+	for name, kbps := range c {
+		caps = append(caps, fmt.Sprintf("%s=%d", name, kbps))
+	}
+	return strings.Join(caps, ",")
+}
+
+func (c bitrateCaps) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected name=kbps, got %q", value)
+	}
+	kbps, err := strconv.Atoi(value[i+1:])
+	if err != nil || kbps <= 0 {
+		return fmt.Errorf("invalid bitrate %q", value[i+1:])
+	}
+	c[value[:i]] = kbps
+	return nil
+}
+
+// publishCap 流的码率上限, bps, streamName 为空时使用默认值
+func publishCap(streamName string) int {
+	if kbps, ok := streamBitrates[streamName]; ok {
+		return kbps * 1000
+	}
+	return *publishBitrate * 1000
+}
+
+// bandwidthFeedback 估计推流连接的接收带宽, 定时用 REMB 告诉推流端
+//
+// 浏览器收到 REMB 后把发送码率降到估计的带宽以下. pion/webrtc v2.1.2 无法协商
+// transport-cc 需要的 RTP 头扩展, 所以只发送 REMB
+type bandwidthFeedback struct {
+	peerConnection *webrtc.PeerConnection
+	estimator      *bwe.Estimator
+
+	mu    sync.Mutex
+	ssrcs map[uint32]bool
+}
+
+func newBandwidthFeedback(peerConnection *webrtc.PeerConnection, streamName string) *bandwidthFeedback {
+	return &bandwidthFeedback{
+		peerConnection: peerConnection,
+		estimator:      bwe.NewEstimator(initialPublishBitrate, minPublishBitrate, limitPublishCap(publishCap(streamName))),
+		ssrcs:          make(map[uint32]bool),
+	}
+}
+
+// add 开始估计 track 的带宽, 第一个 track 开始时启动 REMB 的发送
+func (f *bandwidthFeedback) add(ssrc uint32) {
+	f.mu.Lock()
+	first := len(f.ssrcs) == 0
+	f.ssrcs[ssrc] = true
+	f.mu.Unlock()
+	if first {
+		go f.sendREMB()
+	}
+}
+
+// remove track 结束, 所有 track 结束后停止发送 REMB
+func (f *bandwidthFeedback) remove(ssrc uint32) {
+	f.mu.Lock()
+	delete(f.ssrcs, ssrc)
+	f.mu.Unlock()
+	f.estimator.Forget(ssrc)
+}
+
+// observe 统计收到的包
+func (f *bandwidthFeedback) observe(header *rtp.Header, size int, clockRate uint32) {
+	f.estimator.OnPacket(time.Now(), header.SSRC, header.SequenceNumber, header.Timestamp, clockRate, size)
+}
+
+func (f *bandwidthFeedback) sendREMB() {
+	ticker := time.NewTicker(rembInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		f.mu.Lock()
+		ssrcs := make([]uint32, 0, len(f.ssrcs))
+		for ssrc := range f.ssrcs {
+			ssrcs = append(ssrcs, ssrc)
+		}
+		f.mu.Unlock()
+		if len(ssrcs) == 0 {
+			return
+		}
+		bitrate := f.estimator.Update(now)
+		err := f.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: uint64(bitrate),
+			SSRCs:   ssrcs,
+		}})
+		if err != nil {
+			// 连接已关闭
+			return
+		}
+	}
+}
+
+// meteredReader 读取推流 track 时估计带宽, 统计收到的包
+type meteredReader struct {
+	rtpReader
+	feedback  *bandwidthFeedback
+	stats     *stats.Inbound
+	clockRate uint32
+}
+
+// newMeteredReader 读取推流端的 track, 统计记录在连接的统计中
+func newMeteredReader(peerConnection *webrtc.PeerConnection, track *webrtc.Track, feedback *bandwidthFeedback) meteredReader {
+	codec := track.Codec()
+	in := stats.NewInbound(track.SSRC(), track.Kind().String(), codec.Name, codec.ClockRate)
+	addTrackStats(peerConnection, in)
+	return meteredReader{track, feedback, in, codec.ClockRate}
+}
+
+func (r meteredReader) Read(b []byte) (int, error) {
+	n, err := r.rtpReader.Read(b)
+	if err == nil {
+		header := &rtp.Header{}
+		if header.Unmarshal(b[:n]) == nil {
+			r.feedback.observe(header, n, r.clockRate)
+			r.stats.OnPacket(time.Now(), header, n)
+		}
+	}
+	return n, err
+}
+
+// withREMB 视频编码加上 goog-remb, 浏览器只在协商了 goog-remb 时按 REMB 调整码率
+func withREMB(codec *webrtc.RTPCodec) *webrtc.RTPCodec {
+	codec.RTCPFeedback = append(codec.RTCPFeedback, webrtc.RTCPFeedback{Type: "goog-remb"})
+	return codec
+}
@@ -6,7 +6,7 @@ require (
 	github.com/alfg/mp4 v0.0.0-20190513000601-f1aa2d150bbe
 	github.com/astaxie/beego v1.12.0 // indirect
 	github.com/deepch/mp4 v0.0.0-20160419035333-9a15e569bda9
-	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/gorilla/websocket v1.4.0
 	github.com/graarh/golang-socketio v0.0.0-20170510162725-2c44953b9b5f
 	github.com/nareix/joy4 v0.0.0-20181022032202-3ddbc8f9d431
 	github.com/pion/example-webrtc-applications v0.0.0-20190604070431-3e5c7b4f5cc7
@@ -15,4 +15,5 @@ require (
 	github.com/pion/webrtc/v2 v2.1.2
 	github.com/shiena/ansicolor v0.0.0-20151119151921-a422bbe96644 // indirect
 	github.com/todostreaming/rtmp v0.0.0-20160429180256-3132e4f39241
+	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 )
@@ -1,6 +1,11 @@
 #include "gst.h"
 
 #include <gst/app/gstappsrc.h>
+#include <string.h>
+
+typedef struct SampleHandlerUserData {
+  int pipelineId;
+} SampleHandlerUserData;
 
 GMainLoop *gstreamer_receive_main_loop = NULL;
 void gstreamer_receive_start_mainloop(void) {
@@ -9,13 +14,14 @@ void gstreamer_receive_start_mainloop(void) {
   g_main_loop_run(gstreamer_receive_main_loop);
 }
 
-static gboolean gstreamer_receive_bus_call(GstBus *bus, GstMessage *msg, gpointer data) {
+// gstreamer_receive_bus_sync_handler runs on the thread posting msg, the device does not run the main loop which
+// dispatches bus watches. Errors are handed to Go with the pipeline id instead of exiting, EOS stays on the bus for
+// gstreamer_receive_stop_pipeline
+static GstBusSyncReply gstreamer_receive_bus_sync_handler(GstBus *bus, GstMessage *msg, gpointer data) {
   switch (GST_MESSAGE_TYPE(msg)) {
 
   case GST_MESSAGE_EOS:
-    g_print("End of stream\n");
-    exit(1);
-    break;
+    return GST_BUS_PASS;
 
   case GST_MESSAGE_ERROR: {
     gchar *debug;
@@ -24,32 +30,99 @@ static gboolean gstreamer_receive_bus_call(GstBus *bus, GstMessage *msg, gpointe
     gst_message_parse_error(msg, &error, &debug);
     g_free(debug);
 
-    g_printerr("Error: %s\n", error->message);
+    goHandleSinkError(error->message, GPOINTER_TO_INT(data));
     g_error_free(error);
-    exit(1);
+    break;
   }
   default:
     break;
   }
 
-  return TRUE;
+  return GST_BUS_DROP;
+}
+
+GstFlowReturn gstreamer_receive_new_sample_handler(GstElement *object, gpointer user_data) {
+  GstSample *sample = NULL;
+  GstBuffer *buffer = NULL;
+  gpointer copy = NULL;
+  gsize copy_size = 0;
+  SampleHandlerUserData *s = (SampleHandlerUserData *)user_data;
+
+  g_signal_emit_by_name(object, "pull-sample", &sample);
+  if (sample) {
+    buffer = gst_sample_get_buffer(sample);
+    if (buffer) {
+      gst_buffer_extract_dup(buffer, 0, gst_buffer_get_size(buffer), &copy, &copy_size);
+      goHandleSinkBuffer(copy, copy_size, s->pipelineId);
+    }
+    gst_sample_unref(sample);
+  }
+
+  return GST_FLOW_OK;
 }
 
-GstElement *gstreamer_receive_create_pipeline(char *pipeline) {
+// gstreamer_receive_create_pipeline returns NULL and sets err, which the caller frees, when pipeline can not be parsed
+GstElement *gstreamer_receive_create_pipeline(char *pipeline, char **err) {
   gst_init(NULL, NULL);
   GError *error = NULL;
-  return gst_parse_launch(pipeline, &error);
+  GstElement *element = gst_parse_launch(pipeline, &error);
+  if (error != NULL) {
+    *err = strdup(error->message);
+    g_error_free(error);
+    if (element != NULL) {
+      gst_object_unref(element);
+    }
+    return NULL;
+  }
+  return element;
 }
 
-void gstreamer_receive_start_pipeline(GstElement *pipeline) {
+int gstreamer_receive_has_element(GstElement *pipeline, char *name) {
+  GstElement *element = gst_bin_get_by_name(GST_BIN(pipeline), name);
+  if (element == NULL) {
+    return 0;
+  }
+  gst_object_unref(element);
+  return 1;
+}
+
+void gstreamer_receive_free_pipeline(GstElement *pipeline) { gst_object_unref(pipeline); }
+
+void gstreamer_receive_start_pipeline(GstElement *pipeline, int pipelineId) {
   GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
-  gst_bus_add_watch(bus, gstreamer_receive_bus_call, NULL);
+  gst_bus_set_sync_handler(bus, gstreamer_receive_bus_sync_handler, GINT_TO_POINTER(pipelineId), NULL);
   gst_object_unref(bus);
 
+  GstElement *appsink = gst_bin_get_by_name(GST_BIN(pipeline), "sink");
+  if (appsink != NULL) {
+    SampleHandlerUserData *s = calloc(1, sizeof(SampleHandlerUserData));
+    s->pipelineId = pipelineId;
+    g_object_set(appsink, "emit-signals", TRUE, NULL);
+    g_signal_connect_data(appsink, "new-sample", G_CALLBACK(gstreamer_receive_new_sample_handler), s, (GClosureNotify)free, 0);
+    gst_object_unref(appsink);
+  }
+
   gst_element_set_state(pipeline, GST_STATE_PLAYING);
 }
 
-void gstreamer_receive_stop_pipeline(GstElement *pipeline) { gst_element_set_state(pipeline, GST_STATE_NULL); }
+// gstreamer_receive_stop_pipeline waits up to 5 seconds for the muxer to write the end of the file if eos is set
+void gstreamer_receive_stop_pipeline(GstElement *pipeline, int eos) {
+  if (eos) {
+    GstElement *src = gst_bin_get_by_name(GST_BIN(pipeline), "src");
+    if (src != NULL) {
+      gst_app_src_end_of_stream(GST_APP_SRC(src));
+      gst_object_unref(src);
+
+      GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
+      GstMessage *msg = gst_bus_timed_pop_filtered(bus, 5 * GST_SECOND, GST_MESSAGE_EOS | GST_MESSAGE_ERROR);
+      if (msg != NULL) {
+        gst_message_unref(msg);
+      }
+      gst_object_unref(bus);
+    }
+  }
+  gst_element_set_state(pipeline, GST_STATE_NULL);
+}
 
 void gstreamer_receive_push_buffer(GstElement *pipeline, void *buffer, int len) {
   GstElement *src = gst_bin_get_by_name(GST_BIN(pipeline), "src");
@@ -8,8 +8,16 @@ package gst
 */
 import "C"
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"unsafe"
 
+	"clientgo/gsttemplate"
+	"clientgo/logging"
+
 	"github.com/pion/webrtc/v2"
 )
 
@@ -21,47 +29,355 @@ func StartMainLoop() {
 	C.gstreamer_receive_start_mainloop()
 }
 
+// OutputKind is where a Pipeline sends the received stream
+type OutputKind string
+
+const (
+	// OutputDisplay decodes and plays the stream with autovideosink/autoaudiosink
+	OutputDisplay OutputKind = "display"
+	// OutputFile remuxes the stream into a MKV, MP4 or WebM file
+	OutputFile OutputKind = "file"
+	// OutputFake depayloads the stream and discards it
+	OutputFake OutputKind = "fake"
+	// OutputUDP forwards the RTP packets unchanged with udpsink
+	OutputUDP OutputKind = "udp"
+	// OutputApp depayloads the stream and hands every frame back to Go
+	OutputApp OutputKind = "app"
+)
+
+// Containers of OutputFile
+const (
+	ContainerMKV  = "mkv"
+	ContainerMP4  = "mp4"
+	ContainerWebM = "webm"
+)
+
+// Output configures the end of a Pipeline, the zero value is OutputDisplay
+type Output struct {
+	Kind OutputKind
+
+	// Container and Location of OutputFile
+	Container string
+	Location  string
+
+	// Host and Port of OutputUDP
+	Host string
+	Port int
+
+	// OnBuffer receives the frames of OutputApp. It is called from the
+	// streaming thread and must not block
+	OnBuffer func(buffer []byte)
+}
+
+// codecPipeline is how the RTP packets of a codec are depayloaded and
+// which containers can hold the depayloaded stream
+type codecPipeline struct {
+	caps    string
+	depay   string
+	display string
+	// parse prepares the depayloaded stream for a muxer or appsink
+	parse string
+	// transcode converts the stream for the containers that can not hold
+	// the codec, it is used instead of parse
+	transcode  string
+	containers []string
+}
+
+var codecs = map[string]codecPipeline{
+	webrtc.VP8: {
+		caps:       ", encoding-name=VP8-DRAFT-IETF-01",
+		depay:      "rtpvp8depay",
+		display:    "decodebin ! autovideosink",
+		containers: []string{ContainerMKV, ContainerWebM},
+	},
+	webrtc.VP9: {
+		depay:      "rtpvp9depay",
+		display:    "decodebin ! autovideosink",
+		containers: []string{ContainerMKV, ContainerWebM},
+	},
+	webrtc.H264: {
+		depay:      "rtph264depay",
+		display:    "decodebin ! autovideosink",
+		parse:      "h264parse",
+		containers: []string{ContainerMKV, ContainerMP4},
+	},
+	webrtc.Opus: {
+		caps:       ", payload=96, encoding-name=OPUS",
+		depay:      "rtpopusdepay",
+		display:    "decodebin ! autoaudiosink",
+		parse:      "opusparse",
+		containers: []string{ContainerMKV, ContainerWebM},
+	},
+	webrtc.G722: {
+		caps:    " clock-rate=8000",
+		depay:   "rtpg722depay",
+		display: "decodebin ! autoaudiosink",
+		// no container muxer takes G.722, files hold it as Opus
+		transcode:  "avdec_g722 ! audioconvert ! audioresample ! opusenc",
+		containers: []string{ContainerMKV, ContainerWebM},
+	},
+}
+
+var muxers = map[string]string{
+	ContainerMKV:  "matroskamux",
+	ContainerMP4:  "mp4mux",
+	ContainerWebM: "webmmux",
+}
+
+// Describe returns the pipeline description NewPipeline launches for
+// codecName and out, or an error when the codec or output is unsupported
+func Describe(codecName string, out Output) (string, error) {
+	c, ok := codecs[codecName]
+	if !ok {
+		return "", fmt.Errorf("gst: unhandled codec %s", codecName)
+	}
+	pipelineStr := "appsrc format=time is-live=true do-timestamp=true name=src ! application/x-rtp" + c.caps
+	depay := " ! " + c.depay
+	if c.parse != "" {
+		depay += " ! " + c.parse
+	}
+	switch out.Kind {
+	case OutputDisplay, "":
+		return pipelineStr + " ! " + c.depay + " ! " + c.display, nil
+	case OutputFile:
+		muxer, ok := muxers[out.Container]
+		if !ok {
+			return "", fmt.Errorf("gst: unknown container %q", out.Container)
+		}
+		if !contains(c.containers, out.Container) {
+			return "", fmt.Errorf("gst: %s can not be written to %s", codecName, out.Container)
+		}
+		if out.Location == "" || strings.ContainsAny(out.Location, "\"\\") {
+			return "", fmt.Errorf("gst: invalid file location %q", out.Location)
+		}
+		if c.transcode != "" {
+			depay = " ! " + c.depay + " ! " + c.transcode
+		}
+		return pipelineStr + depay + " ! " + muxer + ` ! filesink location="` + out.Location + `"`, nil
+	case OutputFake:
+		return pipelineStr + " ! " + c.depay + " ! fakesink sync=false", nil
+	case OutputUDP:
+		if out.Host == "" || strings.ContainsAny(out.Host, " !\"") || out.Port <= 0 || out.Port > 65535 {
+			return "", fmt.Errorf("gst: invalid udp address %s:%d", out.Host, out.Port)
+		}
+		return fmt.Sprintf("%s ! udpsink host=%s port=%d sync=false", pipelineStr, out.Host, out.Port), nil
+	case OutputApp:
+		if out.OnBuffer == nil {
+			return "", fmt.Errorf("gst: app output needs OnBuffer")
+		}
+		return pipelineStr + depay + " ! appsink name=sink sync=false", nil
+	}
+	return "", fmt.Errorf("gst: unknown output %q", out.Kind)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Logger writes the errors of pipelines which have no OnError handler
+var Logger, _ = logging.New(os.Stderr, logging.Info, logging.FormatText)
+
 // Pipeline is a wrapper for a GStreamer Pipeline
 type Pipeline struct {
 	Pipeline *C.GstElement
+	id       int
+	output   Output
+	// eos is set when the pipeline may write a file which needs to be
+	// finalized on Stop
+	eos      bool
+	onError  func(error)
+	stopOnce sync.Once
+
+	// mu keeps Push from using the GstElement while it is freed
+	mu    sync.Mutex
+	freed bool
+}
+
+var pipelines = make(map[int]*Pipeline)
+var pipelinesLock sync.Mutex
+var nextPipelineID int
+
+// CreatePipeline creates a GStreamer Pipeline which plays the stream
+func CreatePipeline(codecName string) (*Pipeline, error) {
+	return NewPipeline(codecName, Output{})
+}
+
+// NewPipeline creates a GStreamer Pipeline which sends the stream to out
+func NewPipeline(codecName string, out Output) (*Pipeline, error) {
+	pipelineStr, err := Describe(codecName, out)
+	if err != nil {
+		return nil, err
+	}
+	element, err := parseLaunch(pipelineStr)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(element, out, out.Kind == OutputFile), nil
+}
+
+// NewPipelineFromTemplate creates a GStreamer Pipeline from t expanded
+// with params. The pipeline must start with an appsrc named src, which
+// receives the RTP packets. It is finalized like a file output on Stop
+func NewPipelineFromTemplate(t *gsttemplate.Template, params gsttemplate.Params) (*Pipeline, error) {
+	element, err := parseTemplate(t, params)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(element, Output{}, true), nil
+}
+
+// Validate parses t expanded with params like NewPipelineFromTemplate,
+// without starting it
+func Validate(t *gsttemplate.Template, params gsttemplate.Params) error {
+	element, err := parseTemplate(t, params)
+	if err != nil {
+		return err
+	}
+	C.gstreamer_receive_free_pipeline(element)
+	return nil
 }
 
-// CreatePipeline creates a GStreamer Pipeline
-func CreatePipeline(codecName string) *Pipeline {
-	pipelineStr := "appsrc format=time is-live=true do-timestamp=true name=src ! application/x-rtp"
-	switch codecName {
-	case webrtc.VP8:
-		pipelineStr += ", encoding-name=VP8-DRAFT-IETF-01 ! rtpvp8depay ! decodebin ! autovideosink"
-	case webrtc.Opus:
-		pipelineStr += ", payload=96, encoding-name=OPUS ! rtpopusdepay ! decodebin ! autoaudiosink"
-	case webrtc.VP9:
-		pipelineStr += " ! rtpvp9depay ! decodebin ! autovideosink"
-	case webrtc.H264:
-		pipelineStr += " ! rtph264depay ! decodebin ! autovideosink"
-	case webrtc.G722:
-		pipelineStr += " clock-rate=8000 ! rtpg722depay ! decodebin ! autoaudiosink"
-	default:
-		panic("Unhandled codec " + codecName)
+func parseTemplate(t *gsttemplate.Template, params gsttemplate.Params) (*C.GstElement, error) {
+	element, err := parseLaunch(t.Expand(params))
+	if err != nil {
+		return nil, err
 	}
+	name := C.CString("src")
+	defer C.free(unsafe.Pointer(name))
+	if C.gstreamer_receive_has_element(element, name) == 0 {
+		C.gstreamer_receive_free_pipeline(element)
+		return nil, fmt.Errorf("gst: template has no appsrc named src: %s", t)
+	}
+	return element, nil
+}
 
+// parseLaunch parses a pipeline description, the error explains why
+// GStreamer can not build it
+func parseLaunch(pipelineStr string) (*C.GstElement, error) {
 	pipelineStrUnsafe := C.CString(pipelineStr)
 	defer C.free(unsafe.Pointer(pipelineStrUnsafe))
-	return &Pipeline{Pipeline: C.gstreamer_receive_create_pipeline(pipelineStrUnsafe)}
+	var errUnsafe *C.char
+	element := C.gstreamer_receive_create_pipeline(pipelineStrUnsafe, &errUnsafe)
+	if element == nil {
+		defer C.free(unsafe.Pointer(errUnsafe))
+		return nil, fmt.Errorf("gst: %s: %s", C.GoString(errUnsafe), pipelineStr)
+	}
+	return element, nil
+}
+
+func newPipeline(element *C.GstElement, out Output, eos bool) *Pipeline {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	p := &Pipeline{Pipeline: element, id: nextPipelineID, output: out, eos: eos}
+	nextPipelineID++
+	pipelines[p.id] = p
+	return p
 }
 
 // Start starts the GStreamer Pipeline
 func (p *Pipeline) Start() {
-	C.gstreamer_receive_start_pipeline(p.Pipeline)
+	C.gstreamer_receive_start_pipeline(p.Pipeline, C.int(p.id))
 }
 
-// Stop stops the GStreamer Pipeline
+// Stop stops the GStreamer Pipeline and frees it. File outputs are
+// finalized first, a MP4 file is unreadable without its index. Stopping a
+// pipeline which already failed does nothing
 func (p *Pipeline) Stop() {
-	C.gstreamer_receive_stop_pipeline(p.Pipeline)
+	pipelinesLock.Lock()
+	delete(pipelines, p.id)
+	pipelinesLock.Unlock()
+
+	p.stop(p.eos)
+}
+
+func (p *Pipeline) stop(eos bool) {
+	p.stopOnce.Do(func() {
+		sendEOS := 0
+		if eos {
+			sendEOS = 1
+		}
+		C.gstreamer_receive_stop_pipeline(p.Pipeline, C.int(sendEOS))
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.freed = true
+		C.gstreamer_receive_free_pipeline(p.Pipeline)
+	})
+}
+
+// OnError sets an handler which is called when an element of the
+// Pipeline posts an error. The Pipeline is already stopped when it is
+// called, the other pipelines keep running.
+func (p *Pipeline) OnError(f func(err error)) {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	p.onError = f
+}
+
+// fail stops the Pipeline after an error. It runs off the streaming
+// thread, stopping a pipeline from its own thread would deadlock. A
+// failed pipeline can not finalize its file, it is stopped without EOS.
+// Only the first error of a running pipeline is handled, elements post
+// errors from their own streaming threads
+func (p *Pipeline) fail(err error) {
+	pipelinesLock.Lock()
+	_, running := pipelines[p.id]
+	delete(pipelines, p.id)
+	onError := p.onError
+	pipelinesLock.Unlock()
+
+	if !running {
+		return
+	}
+	go func() {
+		p.stop(false)
+		if onError != nil {
+			onError(err)
+		} else {
+			Logger.Error("gstreamer pipeline stopped", "pipeline", p.id, "error", err)
+		}
+	}()
 }
 
-// Push pushes a buffer on the appsrc of the GStreamer Pipeline
+// Push pushes a buffer on the appsrc of the GStreamer Pipeline, buffers
+// pushed after the Pipeline stopped are dropped
 func (p *Pipeline) Push(buffer []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.freed {
+		return
+	}
 	b := C.CBytes(buffer)
 	defer C.free(b)
 	C.gstreamer_receive_push_buffer(p.Pipeline, b, C.int(len(buffer)))
 }
+
+//export goHandleSinkBuffer
+func goHandleSinkBuffer(buffer unsafe.Pointer, bufferLen C.int, pipelineID C.int) {
+	pipelinesLock.Lock()
+	pipeline, ok := pipelines[int(pipelineID)]
+	pipelinesLock.Unlock()
+
+	if ok && pipeline.output.OnBuffer != nil {
+		pipeline.output.OnBuffer(C.GoBytes(buffer, bufferLen))
+	}
+	C.free(buffer)
+}
+
+//export goHandleSinkError
+func goHandleSinkError(message *C.char, pipelineID C.int) {
+	pipelinesLock.Lock()
+	pipeline, ok := pipelines[int(pipelineID)]
+	pipelinesLock.Unlock()
+
+	// the pipeline was stopped or has already failed, fail checks again
+	// in case another error stops it meanwhile
+	if ok {
+		pipeline.fail(errors.New("gst: " + C.GoString(message)))
+	}
+}
@@ -6,9 +6,14 @@
 #include <stdint.h>
 #include <stdlib.h>
 
-GstElement *gstreamer_receive_create_pipeline(char *pipeline);
-void gstreamer_receive_start_pipeline(GstElement *pipeline);
-void gstreamer_receive_stop_pipeline(GstElement *pipeline);
+extern void goHandleSinkBuffer(void *buffer, int bufferLen, int pipelineId);
+extern void goHandleSinkError(char *message, int pipelineId);
+
+GstElement *gstreamer_receive_create_pipeline(char *pipeline, char **err);
+int gstreamer_receive_has_element(GstElement *pipeline, char *name);
+void gstreamer_receive_free_pipeline(GstElement *pipeline);
+void gstreamer_receive_start_pipeline(GstElement *pipeline, int pipelineId);
+void gstreamer_receive_stop_pipeline(GstElement *pipeline, int eos);
 void gstreamer_receive_push_buffer(GstElement *pipeline, void *buffer, int len);
 void gstreamer_receive_start_mainloop(void);
 
@@ -1,6 +1,7 @@
 #include "gst.h"
 
 #include <gst/app/gstappsrc.h>
+#include <string.h>
 
 typedef struct SampleHandlerUserData {
   int pipelineId;
@@ -13,12 +14,13 @@ void gstreamer_send_start_mainloop(void) {
   g_main_loop_run(gstreamer_send_main_loop);
 }
 
+// gstreamer_send_bus_call hands the end and the errors of the pipeline, whose id is data, to Go which stops only
+// that pipeline
 static gboolean gstreamer_send_bus_call(GstBus *bus, GstMessage *msg, gpointer data) {
   switch (GST_MESSAGE_TYPE(msg)) {
 
   case GST_MESSAGE_EOS:
-    g_print("End of stream\n");
-    exit(1);
+    goHandlePipelineEOS(GPOINTER_TO_INT(data));
     break;
 
   case GST_MESSAGE_ERROR: {
@@ -28,9 +30,9 @@ static gboolean gstreamer_send_bus_call(GstBus *bus, GstMessage *msg, gpointer d
     gst_message_parse_error(msg, &error, &debug);
     g_free(debug);
 
-    g_printerr("Error: %s\n", error->message);
+    goHandlePipelineError(error->message, GPOINTER_TO_INT(data));
     g_error_free(error);
-    exit(1);
+    break;
   }
   default:
     break;
@@ -59,30 +61,47 @@ GstFlowReturn gstreamer_send_new_sample_handler(GstElement *object, gpointer use
   return GST_FLOW_OK;
 }
 
-GstElement *gstreamer_send_create_pipeline(char *pipeline) {
+// gstreamer_send_create_pipeline returns NULL and sets err, which the caller frees, when pipeline can not be parsed
+GstElement *gstreamer_send_create_pipeline(char *pipeline, char **err) {
   gst_init(NULL, NULL);
   GError *error = NULL;
-  return gst_parse_launch(pipeline, &error);
+  GstElement *element = gst_parse_launch(pipeline, &error);
+  if (error != NULL) {
+    *err = strdup(error->message);
+    g_error_free(error);
+    if (element != NULL) {
+      gst_object_unref(element);
+    }
+    return NULL;
+  }
+  return element;
 }
 
+void gstreamer_send_free_pipeline(GstElement *pipeline) { gst_object_unref(pipeline); }
+
 void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId) {
   SampleHandlerUserData *s = calloc(1, sizeof(SampleHandlerUserData));
   s->pipelineId = pipelineId;
 
   GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
-  gst_bus_add_watch(bus, gstreamer_send_bus_call, NULL);
+  gst_bus_add_watch(bus, gstreamer_send_bus_call, GINT_TO_POINTER(pipelineId));
   gst_object_unref(bus);
 
   GstElement *appsink = gst_bin_get_by_name(GST_BIN(pipeline), "appsink");
   g_object_set(appsink, "emit-signals", TRUE, NULL);
-  g_signal_connect(appsink, "new-sample", G_CALLBACK(gstreamer_send_new_sample_handler), s);
+  g_signal_connect_data(appsink, "new-sample", G_CALLBACK(gstreamer_send_new_sample_handler), s, (GClosureNotify)free, 0);
   gst_object_unref(appsink);
 
   gst_element_set_state(pipeline, GST_STATE_PLAYING);
 }
 
+// gstreamer_send_stop_pipeline also removes the bus watch, which would keep the bus alive after the pipeline is freed
 void gstreamer_send_stop_pipeline(GstElement *pipeline) {
   gst_element_set_state(pipeline, GST_STATE_NULL);
+
+  GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
+  gst_bus_remove_watch(bus);
+  gst_object_unref(bus);
 }
 
 
@@ -8,10 +8,17 @@ package gst
 */
 import "C"
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"sync"
 	"unsafe"
 
+	"clientgo/gsttemplate"
+	"clientgo/logging"
+
 	"github.com/pion/webrtc/v2"
 	"github.com/pion/webrtc/v2/pkg/media"
 )
@@ -20,48 +27,124 @@ func init() {
 	go C.gstreamer_send_start_mainloop()
 }
 
+// Logger writes the errors of pipelines which have no OnError handler
+var Logger, _ = logging.New(os.Stderr, logging.Info, logging.FormatText)
+
 // Pipeline is a wrapper for a GStreamer Pipeline
 type Pipeline struct {
 	Pipeline  *C.GstElement
 	tracks    []*webrtc.Track
 	id        int
-	codecName string
+	clockRate uint32
+	onError   func(error)
+	stopOnce  sync.Once
 }
 
 var pipelines = make(map[int]*Pipeline)
 var pipelinesLock sync.Mutex
+var nextPipelineID int
+
+// defaultEncoders are the encoders of the codecs until SetEncoders
+// replaces them
+var defaultEncoders = map[string]string{
+	webrtc.VP8:  "vp8enc error-resilient=partitions keyframe-max-dist=10 auto-alt-ref=true cpu-used=5 deadline=1",
+	webrtc.VP9:  "vp9enc",
+	webrtc.H264: "video/x-raw,format=I420 ! x264enc bframes=0 speed-preset=veryfast key-int-max=60 ! video/x-h264,stream-format=byte-stream",
+	webrtc.Opus: "opusenc",
+	webrtc.G722: "avenc_g722",
+}
+
+var encoders = make(gsttemplate.Config)
+var encodersLock sync.Mutex
+
+func init() {
+	for codec, text := range defaultEncoders {
+		t, err := gsttemplate.Parse(text)
+		if err != nil {
+			panic(err)
+		}
+		encoders[strings.ToLower(codec)] = t
+	}
+}
+
+// SetEncoders replaces the encoders of the codecs in c, the other codecs
+// keep theirs. Every encoder is checked by GStreamer behind a test source
+// first, nothing is replaced when one fails
+func SetEncoders(c gsttemplate.Config) error {
+	for codec, t := range c {
+		params, ok := gsttemplate.CodecParams(codec)
+		if !ok {
+			return fmt.Errorf("gst: unhandled codec %s", codec)
+		}
+		testSrc := "videotestsrc num-buffers=1"
+		if params.Codec == webrtc.Opus || params.Codec == webrtc.G722 {
+			testSrc = "audiotestsrc num-buffers=1"
+		}
+		element, err := parseLaunch(describe(testSrc, t, params))
+		if err != nil {
+			return err
+		}
+		C.gstreamer_send_free_pipeline(element)
+	}
 
-// CreatePipeline creates a GStreamer Pipeline
-func CreatePipeline(codecName string, tracks []*webrtc.Track, pipelineSrc string) *Pipeline {
-	pipelineStr := "appsink name=appsink"
-	switch codecName {
-	case webrtc.VP8:
-		pipelineStr = pipelineSrc + " ! vp8enc error-resilient=partitions keyframe-max-dist=10 auto-alt-ref=true cpu-used=5 deadline=1 ! " + pipelineStr
-	case webrtc.VP9:
-		pipelineStr = pipelineSrc + " ! vp9enc ! " + pipelineStr
-	case webrtc.H264:
-		pipelineStr = pipelineSrc + " ! video/x-raw,format=I420 ! x264enc bframes=0 speed-preset=veryfast key-int-max=60 ! video/x-h264,stream-format=byte-stream ! " + pipelineStr
-	case webrtc.Opus:
-		pipelineStr = pipelineSrc + " ! opusenc ! " + pipelineStr
-	case webrtc.G722:
-		pipelineStr = pipelineSrc + " ! avenc_g722 ! " + pipelineStr
-	default:
-		panic("Unhandled codec " + codecName)
+	encodersLock.Lock()
+	defer encodersLock.Unlock()
+	for codec, t := range c {
+		encoders[codec] = t
 	}
+	return nil
+}
+
+// describe puts the encoder t between pipelineSrc and the appsink
+// receiving the samples
+func describe(pipelineSrc string, t *gsttemplate.Template, params gsttemplate.Params) string {
+	return pipelineSrc + " ! " + t.Expand(params) + " ! appsink name=appsink"
+}
 
+// CreatePipeline creates a GStreamer Pipeline which encodes pipelineSrc
+// with the encoder of codecName and writes the samples to tracks
+func CreatePipeline(codecName string, tracks []*webrtc.Track, pipelineSrc string) (*Pipeline, error) {
+	params, ok := gsttemplate.CodecParams(codecName)
+	encodersLock.Lock()
+	t := encoders.Lookup(codecName)
+	encodersLock.Unlock()
+	if !ok || t == nil {
+		return nil, fmt.Errorf("gst: unhandled codec %s", codecName)
+	}
+
+	element, err := parseLaunch(describe(pipelineSrc, t, params))
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(element, tracks, params.ClockRate), nil
+}
+
+// parseLaunch parses a pipeline description, the error explains why
+// GStreamer can not build it
+func parseLaunch(pipelineStr string) (*C.GstElement, error) {
 	pipelineStrUnsafe := C.CString(pipelineStr)
 	defer C.free(unsafe.Pointer(pipelineStrUnsafe))
+	var errUnsafe *C.char
+	element := C.gstreamer_send_create_pipeline(pipelineStrUnsafe, &errUnsafe)
+	if element == nil {
+		defer C.free(unsafe.Pointer(errUnsafe))
+		return nil, fmt.Errorf("gst: %s: %s", C.GoString(errUnsafe), pipelineStr)
+	}
+	return element, nil
+}
 
+func newPipeline(element *C.GstElement, tracks []*webrtc.Track, clockRate uint32) *Pipeline {
 	pipelinesLock.Lock()
 	defer pipelinesLock.Unlock()
 
 	pipeline := &Pipeline{
-		Pipeline:  C.gstreamer_send_create_pipeline(pipelineStrUnsafe),
+		Pipeline:  element,
 		tracks:    tracks,
-		id:        len(pipelines),
-		codecName: codecName,
+		id:        nextPipelineID,
+		clockRate: clockRate,
 	}
 
+	nextPipelineID++
 	pipelines[pipeline.id] = pipeline
 	return pipeline
 }
@@ -71,15 +154,52 @@ func (p *Pipeline) Start() {
 	C.gstreamer_send_start_pipeline(p.Pipeline, C.int(p.id))
 }
 
-// Stop stops the GStreamer Pipeline
+// Stop stops the GStreamer Pipeline and frees it, the Pipeline can not be
+// started again. Stopping a pipeline twice does nothing
 func (p *Pipeline) Stop() {
-	C.gstreamer_send_stop_pipeline(p.Pipeline)
+	pipelinesLock.Lock()
+	delete(pipelines, p.id)
+	pipelinesLock.Unlock()
+
+	p.stopOnce.Do(func() {
+		C.gstreamer_send_stop_pipeline(p.Pipeline)
+		C.gstreamer_send_free_pipeline(p.Pipeline)
+	})
 }
 
-const (
-	videoClockRate = 90000
-	audioClockRate = 48000
-)
+// OnError sets an handler which is called when writing a sample to the
+// tracks fails, an element posts an error or the source ends with
+// io.EOF. The Pipeline is already stopped when it is called, only the
+// session owning the tracks should be closed.
+func (p *Pipeline) OnError(f func(err error)) {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	p.onError = f
+}
+
+// fail stops the Pipeline after an error. It runs off the streaming
+// thread, stopping a pipeline from its own thread would deadlock. Only
+// the first error of a running pipeline is handled, a sample write error
+// and a bus error may arrive together
+func (p *Pipeline) fail(err error) {
+	pipelinesLock.Lock()
+	_, running := pipelines[p.id]
+	delete(pipelines, p.id)
+	onError := p.onError
+	pipelinesLock.Unlock()
+
+	if !running {
+		return
+	}
+	go func() {
+		p.Stop()
+		if onError != nil {
+			onError(err)
+		} else {
+			Logger.Error("gstreamer pipeline stopped", "pipeline", p.id, "error", err)
+		}
+	}()
+}
 
 //export goHandlePipelineBuffer
 func goHandlePipelineBuffer(buffer unsafe.Pointer, bufferLen C.int, duration C.int, pipelineID C.int) {
@@ -88,19 +208,38 @@ func goHandlePipelineBuffer(buffer unsafe.Pointer, bufferLen C.int, duration C.i
 	pipelinesLock.Unlock()
 
 	if ok {
-		var samples uint32
-		if pipeline.codecName == webrtc.Opus {
-			samples = uint32(audioClockRate * (float32(duration) / 1000000000))
-		} else {
-			samples = uint32(videoClockRate * (float32(duration) / 1000000000))
-		}
+		samples := uint32(float32(pipeline.clockRate) * (float32(duration) / 1000000000))
 		for _, t := range pipeline.tracks {
-			if err := t.WriteSample(media.Sample{Data: C.GoBytes(buffer, bufferLen), Samples: samples}); err != nil {
-				panic(err)
+			// ErrClosedPipe means nobody is receiving the track yet
+			if err := t.WriteSample(media.Sample{Data: C.GoBytes(buffer, bufferLen), Samples: samples}); err != nil && err != io.ErrClosedPipe {
+				pipeline.fail(err)
+				break
 			}
 		}
 	} else {
-		fmt.Printf("discarding buffer, no pipeline with id %d", int(pipelineID))
+		Logger.Debug("discarding buffer of a stopped pipeline", "pipeline", int(pipelineID))
 	}
 	C.free(buffer)
 }
+
+//export goHandlePipelineError
+func goHandlePipelineError(message *C.char, pipelineID C.int) {
+	failPipeline(int(pipelineID), errors.New("gst: "+C.GoString(message)))
+}
+
+//export goHandlePipelineEOS
+func goHandlePipelineEOS(pipelineID C.int) {
+	failPipeline(int(pipelineID), io.EOF)
+}
+
+// failPipeline stops the pipeline id unless it was stopped or has
+// already failed, fail checks again in case it fails meanwhile
+func failPipeline(id int, err error) {
+	pipelinesLock.Lock()
+	pipeline, ok := pipelines[id]
+	pipelinesLock.Unlock()
+
+	if ok {
+		pipeline.fail(err)
+	}
+}
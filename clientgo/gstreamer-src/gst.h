@@ -7,8 +7,11 @@
 #include <stdlib.h>
 
 extern void goHandlePipelineBuffer(void *buffer, int bufferLen, int samples, int pipelineId);
+extern void goHandlePipelineError(char *message, int pipelineId);
+extern void goHandlePipelineEOS(int pipelineId);
 
-GstElement *gstreamer_send_create_pipeline(char *pipeline);
+GstElement *gstreamer_send_create_pipeline(char *pipeline, char **err);
+void gstreamer_send_free_pipeline(GstElement *pipeline);
 void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId);
 void gstreamer_send_stop_pipeline(GstElement *pipeline);
 void gstreamer_send_start_mainloop(void);
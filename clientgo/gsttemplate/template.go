@@ -0,0 +1,173 @@
+// Package gsttemplate expands GStreamer pipeline templates loaded from
+// configuration, so the encoders and sinks of the gstreamer-src and
+// gstreamer-sink packages can be changed without rebuilding the device.
+//
+// A template is a gst-launch pipeline description with the placeholders
+// ${codec}, ${payload-type} and ${clock-rate}. A sink template is a
+// complete pipeline receiving RTP packets, e.g.
+//
+//	appsrc name=src format=time is-live=true do-timestamp=true !
+//	application/x-rtp, encoding-name=${codec}, payload=${payload-type}, clock-rate=${clock-rate} !
+//	rtpvp8depay ! webmmux ! filesink location=out.webm
+//
+// A src template is the encoder put between a source and the appsink,
+// e.g.
+//
+//	vp8enc deadline=1 cpu-used=5
+package gsttemplate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Params are the values substituted for the placeholders
+type Params struct {
+	Codec       string
+	PayloadType uint8
+	ClockRate   uint32
+}
+
+// Template is a parsed pipeline template
+type Template struct {
+	text string
+}
+
+// placeholders known by Expand
+var placeholders = []string{"codec", "payload-type", "clock-rate"}
+
+// Parse checks that text is not empty and that every ${...} in it is a
+// known placeholder. The pipeline itself is only checked by GStreamer, see
+// Validate of gstreamer-sink and SetEncoders of gstreamer-src
+func Parse(text string) (*Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("gsttemplate: empty template")
+	}
+	rest := text
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			break
+		}
+		rest = rest[i+2:]
+		j := strings.Index(rest, "}")
+		if j < 0 {
+			return nil, fmt.Errorf("gsttemplate: unterminated placeholder in %q", text)
+		}
+		if !known(rest[:j]) {
+			return nil, fmt.Errorf("gsttemplate: unknown placeholder ${%s}, expected one of %s", rest[:j], strings.Join(placeholders, ", "))
+		}
+		rest = rest[j+1:]
+	}
+	return &Template{text: text}, nil
+}
+
+func known(name string) bool {
+	for _, p := range placeholders {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns the pipeline description with the placeholders replaced
+// by p
+func (t *Template) Expand(p Params) string {
+	return strings.NewReplacer(
+		"${codec}", p.Codec,
+		"${payload-type}", strconv.Itoa(int(p.PayloadType)),
+		"${clock-rate}", strconv.FormatUint(uint64(p.ClockRate), 10),
+	).Replace(t.text)
+}
+
+func (t *Template) String() string {
+	return t.text
+}
+
+// Config maps codec names to templates, names are case-insensitive
+type Config map[string]*Template
+
+// Set is a template file, the sink templates are used by the
+// gstreamer-sink package and the src templates by the gstreamer-src
+// package:
+//
+//	{"sink": {"VP8": "appsrc name=src ..."}, "src": {"VP8": "vp8enc ..."}}
+type Set struct {
+	Sink Config
+	Src  Config
+}
+
+// Load reads a Set from a JSON file
+func Load(path string) (*Set, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSet(data)
+}
+
+// ParseSet parses a JSON object with the sections sink and src, both are
+// optional
+func ParseSet(data []byte) (*Set, error) {
+	var texts struct {
+		Sink map[string]string `json:"sink"`
+		Src  map[string]string `json:"src"`
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&texts); err != nil {
+		return nil, fmt.Errorf("gsttemplate: %v", err)
+	}
+	sink, err := parseConfig(texts.Sink)
+	if err != nil {
+		return nil, err
+	}
+	src, err := parseConfig(texts.Src)
+	if err != nil {
+		return nil, err
+	}
+	return &Set{Sink: sink, Src: src}, nil
+}
+
+// parseConfig parses the templates of a section
+func parseConfig(texts map[string]string) (Config, error) {
+	c := make(Config, len(texts))
+	for codec, text := range texts {
+		t, err := Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%v (codec %s)", err, codec)
+		}
+		c[strings.ToLower(codec)] = t
+	}
+	return c, nil
+}
+
+// Lookup returns the template of codecName, nil if there is none
+func (c Config) Lookup(codecName string) *Template {
+	return c[strings.ToLower(codecName)]
+}
+
+// CodecParams returns the default payload type and the clock rate of
+// codecName registered by pion, false for an unknown codec
+func CodecParams(codecName string) (Params, bool) {
+	params := []Params{
+		{Codec: webrtc.VP8, PayloadType: webrtc.DefaultPayloadTypeVP8, ClockRate: 90000},
+		{Codec: webrtc.VP9, PayloadType: webrtc.DefaultPayloadTypeVP9, ClockRate: 90000},
+		{Codec: webrtc.H264, PayloadType: webrtc.DefaultPayloadTypeH264, ClockRate: 90000},
+		{Codec: webrtc.Opus, PayloadType: webrtc.DefaultPayloadTypeOpus, ClockRate: 48000},
+		{Codec: webrtc.G722, PayloadType: webrtc.DefaultPayloadTypeG722, ClockRate: 8000},
+	}
+	for _, p := range params {
+		if strings.EqualFold(p.Codec, codecName) {
+			return p, true
+		}
+	}
+	return Params{}, false
+}
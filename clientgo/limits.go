@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"clientgo/signal"
+)
+
+var (
+	// 资源上限, 0 为不限制. 在 askToConnect、重新协商和 WHIP/WHEP 建立连接时检查
+	maxSessions         = flag.Int("max-sessions", 0, "most connections the device accepts at the same time, 0 for no limit")
+	maxPublishers       = flag.Int("max-publishers", 0, "most publishers at the same time, 0 for no limit")
+	maxViewersPerStream = flag.Int("max-viewers-per-stream", 0, "most viewers of one live stream, 0 for no limit")
+	maxFilePlaybacks    = flag.Int("max-file-playbacks", 0, "most files played at the same time, 0 for no limit")
+	// 每个会话的视频码率上限, kbps. 推流端通过 REMB 限制, 拉流端选择码率不超过上限的层, 播放文件不限制
+	maxSessionBitrate = flag.Int("max-session-bitrate", 0, "upper bound of a session's video bitrate in kbps, 0 for no limit")
+)
+
+// usage 一个连接占用的资源
+type usage struct {
+	publisher bool
+	// streams 拉取的直播流, 同一个流只计一次
+	streams []string
+	files   int
+}
+
+// usageOf 按会话的动作和 track 计算占用的资源
+func usageOf(action signal.Action, tracks []signal.Track) usage {
+	u := usage{publisher: action.IsPush()}
+	if u.publisher {
+		return u
+	}
+	for _, t := range tracks {
+		if t.Stream != "" {
+			if !containsString(u.streams, t.Stream) {
+				u.streams = append(u.streams, t.Stream)
+			}
+		} else {
+			u.files++
+		}
+	}
+	return u
+}
+
+// checkLimits id 的占用换成 u 后是否超过上限, all 为所有连接的占用.
+// 只检查 u 用到的资源, 调小上限后已有的连接不影响其他类型的连接
+func checkLimits(all map[string]usage, id string, u usage) error {
+	sessions, publishers, files := 1, 0, 0
+	viewers := make(map[string]int)
+	for other, o := range all {
+		if other == id {
+			continue
+		}
+		sessions++
+		if o.publisher {
+			publishers++
+		}
+		files += o.files
+		for _, name := range o.streams {
+			viewers[name]++
+		}
+	}
+	if *maxSessions > 0 && sessions > *maxSessions {
+		return limitExceeded("too many sessions, at most %d", *maxSessions)
+	}
+	if u.publisher && *maxPublishers > 0 && publishers+1 > *maxPublishers {
+		return limitExceeded("too many publishers, at most %d", *maxPublishers)
+	}
+	if u.files > 0 && *maxFilePlaybacks > 0 && files+u.files > *maxFilePlaybacks {
+		return limitExceeded("too many file playbacks, at most %d", *maxFilePlaybacks)
+	}
+	if *maxViewersPerStream > 0 {
+		for _, name := range u.streams {
+			if viewers[name]+1 > *maxViewersPerStream {
+				return limitExceeded("too many viewers of stream %s, at most %d", name, *maxViewersPerStream)
+			}
+		}
+	}
+	return nil
+}
+
+func limitExceeded(format string, args ...interface{}) error {
+	return signal.NewError(signal.CodeLimitExceeded, fmt.Sprintf(format, args...))
+}
+
+// limitPublishCap 推流端的码率上限不超过 -max-session-bitrate, bps
+func limitPublishCap(bps int) int {
+	if *maxSessionBitrate > 0 && bps > *maxSessionBitrate*1000 {
+		return *maxSessionBitrate * 1000
+	}
+	return bps
+}
+
+// limitBandwidth 拉流端的带宽不超过 -max-session-bitrate, kbps, 0 为不限制
+func limitBandwidth(kbps int) int {
+	if *maxSessionBitrate > 0 && (kbps <= 0 || kbps > *maxSessionBitrate) {
+		return *maxSessionBitrate
+	}
+	return kbps
+}
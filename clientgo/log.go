@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	gst "clientgo/gstreamer-sink"
+	gstsrc "clientgo/gstreamer-src"
+	"clientgo/logging"
+	"clientgo/signal"
+)
+
+var (
+	// logger 设备的日志, 启动时按 -log-level 和 -log-format 配置, 每条日志带设备 ID
+	logger    *logging.Logger
+	logLevel  = flag.String("log-level", "info", "log level: debug, info, warn or error, every RTP packet is traced at debug")
+	logFormat = flag.String("log-format", logging.FormatText, "log format: text or json")
+)
+
+func init() {
+	// 配置之前使用默认的日志
+	logger, _ = logging.New(os.Stderr, logging.Info, logging.FormatText)
+}
+
+// setupLogger 按启动参数配置日志
+func setupLogger() error {
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	l, err := logging.New(os.Stderr, level, *logFormat)
+	if err != nil {
+		return err
+	}
+	logger = l.With("device", mac)
+	gst.Logger = logger
+	gstsrc.Logger = logger
+	return nil
+}
+
+// clientLogger 客户端会话的日志, 带客户端 ID 和动作
+func clientLogger(clientID string, action signal.Action) *logging.Logger {
+	return logger.With("client", clientID, "action", action)
+}
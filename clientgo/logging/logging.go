@@ -0,0 +1,200 @@
+// Package logging is a small levelled logger. Every entry is written as
+// one line, as text or as a JSON object, with the fields of the logger
+// and of the entry.
+//
+// Fields are key, value pairs. A logger made by With carries its fields
+// into every entry, so a session can log with its client ID and a track
+// with its SSRC without repeating them.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of an entry
+type Level int
+
+// Levels from the most verbose
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel parses the name of a level, as returned by Level.String
+func ParseLevel(s string) (Level, error) {
+	for l := Debug; l <= Error; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Formats of the entries
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Logger writes entries at or above its level. It is safe for concurrent
+// use, loggers made by With share the output of their parent.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// output is the writer shared by a logger and its children
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+// New returns a logger writing entries at or above level to w, format is
+// FormatText or FormatJSON
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &Logger{out: &output{w: w, level: level, json: format == FormatJSON}}, nil
+}
+
+// With returns a logger adding the key, value pairs to every entry
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether entries of level are written. Callers check it
+// before building expensive fields, like per packet tracing.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// Debug writes an entry for tracing, disabled by default
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(Debug, msg, keyValues)
+}
+
+// Info writes an entry about the normal operation
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(Info, msg, keyValues)
+}
+
+// Warn writes an entry about a problem the program recovers from
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(Warn, msg, keyValues)
+}
+
+// Error writes an entry about a failed operation
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(Error, msg, keyValues)
+}
+
+// Fatal writes an error entry and exits the program
+func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
+	l.log(Error, msg, keyValues)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keyValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(l.fields[:len(l.fields):len(l.fields)], keyValues...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+	now := time.Now()
+	var b strings.Builder
+	if l.out.json {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSON(&b, fmt.Sprint(fields[i]))
+			b.WriteByte(':')
+			writeJSON(&b, value(fields[i+1]))
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+		b.WriteByte(' ')
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteByte(' ')
+		b.WriteString(msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteByte(' ')
+			b.WriteString(fmt.Sprint(fields[i]))
+			b.WriteByte('=')
+			b.WriteString(textValue(value(fields[i+1])))
+		}
+		b.WriteByte('\n')
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, b.String())
+}
+
+// value converts errors and Stringers to strings, other values are
+// written as they are
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// writeJSON writes v as JSON, without escaping HTML characters in URLs
+func writeJSON(b *strings.Builder, v interface{}) {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if e.Encode(v) != nil {
+		buf.Reset()
+		e.Encode(fmt.Sprint(v))
+	}
+	b.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// textValue quotes strings that would not read as a single value
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
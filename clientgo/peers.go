@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"clientgo/signal"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// peers 设备的所有连接, key 为客户端 ID
+var peers = newPeerTable()
+
+// peerTable 客户端的连接和信令会话, 可以并发使用
+//
+// 每个客户端有一个当前的 pc. 通过 askToConnect 建立的连接还有一个 session,
+// WHIP/WHEP 的连接只有 pc, 不支持重新协商.
+// 同一个客户端的 askToConnect 同时到达时只创建一个会话, 见 getOrCreate.
+// 添加连接和重新协商时检查资源上限, 见 checkLimits
+type peerTable struct {
+	mu       sync.Mutex
+	pcs      map[string]*webrtc.PeerConnection
+	sessions map[string]*session
+	// creating 正在创建的会话, 创建完成后关闭 done
+	creating map[string]*creation
+	// usage 每个连接占用的资源, 包括正在创建的会话
+	usage map[string]usage
+}
+
+type creation struct {
+	done chan struct{}
+	err  error
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{
+		pcs:      make(map[string]*webrtc.PeerConnection),
+		sessions: make(map[string]*session),
+		creating: make(map[string]*creation),
+		usage:    make(map[string]usage),
+	}
+}
+
+// get 返回客户端当前的 pc 和会话, 没有时为 nil
+func (t *peerTable) get(id string) (*webrtc.PeerConnection, *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pcs[id], t.sessions[id]
+}
+
+// peerConnection 返回客户端当前的 pc, 没有时为 nil
+func (t *peerTable) peerConnection(id string) *webrtc.PeerConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pcs[id]
+}
+
+// session 返回客户端通过信令建立的会话, 没有时为 nil
+func (t *peerTable) session(id string) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[id]
+}
+
+// isCurrent peerConnection 是否为客户端当前的 pc, 连接关闭或者重新协商替换后为 false
+func (t *peerTable) isCurrent(id string, peerConnection *webrtc.PeerConnection) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pcs[id] == peerConnection
+}
+
+// getOrCreate 客户端没有会话时调用 create 创建, 返回是否创建了新的会话
+//
+// 同一个客户端的并发请求只有一个调用 create, 其余的等待它完成, 创建失败时返回同一个错误.
+// 会话占用 u 后超过资源上限时不创建. 设备正在关闭时不再添加会话, create 创建的 pc 被关闭
+func (t *peerTable) getOrCreate(id string, u usage, create func() (*webrtc.PeerConnection, *session, error)) (bool, error) {
+	t.mu.Lock()
+	if t.pcs[id] != nil {
+		t.mu.Unlock()
+		return false, nil
+	}
+	if c := t.creating[id]; c != nil {
+		t.mu.Unlock()
+		<-c.done
+		return false, c.err
+	}
+	if err := checkLimits(t.usage, id, u); err != nil {
+		t.mu.Unlock()
+		return false, err
+	}
+	c := &creation{done: make(chan struct{})}
+	t.creating[id] = c
+	t.usage[id] = u
+	t.mu.Unlock()
+
+	pc, sess, err := create()
+
+	t.mu.Lock()
+	if err == nil && isShuttingDown() {
+		err = errShuttingDown
+	}
+	if err == nil {
+		t.pcs[id] = pc
+		t.sessions[id] = sess
+		t.usage[id] = u
+	} else {
+		delete(t.usage, id)
+	}
+	delete(t.creating, id)
+	c.err = err
+	t.mu.Unlock()
+	close(c.done)
+
+	if err != nil && pc != nil {
+		if sess != nil {
+			sess.close()
+		}
+		pc.Close()
+	}
+	return err == nil, err
+}
+
+// add 添加 WHIP/WHEP 的连接, id 由设备生成, 不会重复.
+// 设备正在关闭时返回 errShuttingDown, 超过资源上限时返回 limit_exceeded 错误
+func (t *peerTable) add(id string, peerConnection *webrtc.PeerConnection, u usage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if isShuttingDown() {
+		return errShuttingDown
+	}
+	if err := checkLimits(t.usage, id, u); err != nil {
+		return err
+	}
+	t.pcs[id] = peerConnection
+	t.usage[id] = u
+	return nil
+}
+
+// check 连接占用 u 后是否超过资源上限, 只用于提前拒绝, 添加时还会再检查
+func (t *peerTable) check(id string, u usage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return checkLimits(t.usage, id, u)
+}
+
+// updateUsage 重新协商修改会话的 track, 占用 u 后超过资源上限时返回错误.
+// 返回之前的占用, 重新协商失败时用 restoreUsage 恢复
+func (t *peerTable) updateUsage(id string, u usage) (usage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.usage[id]
+	if !ok {
+		return old, signal.NewError(signal.CodeSessionNotFound, "session closed")
+	}
+	if err := checkLimits(t.usage, id, u); err != nil {
+		return old, err
+	}
+	t.usage[id] = u
+	return old, nil
+}
+
+// restoreUsage 恢复 updateUsage 之前的占用, 会话已经关闭时不恢复
+func (t *peerTable) restoreUsage(id string, u usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.usage[id]; ok {
+		t.usage[id] = u
+	}
+}
+
+// replace 重新协商的 pc 替换会话当前的 pc, 返回被替换的 pc. 会话已经关闭时返回 false
+func (t *peerTable) replace(sess *session, peerConnection *webrtc.PeerConnection) (*webrtc.PeerConnection, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[sess.id] != sess {
+		return nil, false
+	}
+	old := t.pcs[sess.id]
+	t.pcs[sess.id] = peerConnection
+	return old, true
+}
+
+// remove 删除客户端的连接和会话, 返回删除的 pc 和会话
+func (t *peerTable) remove(id string) (*webrtc.PeerConnection, *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pc, sess := t.pcs[id], t.sessions[id]
+	delete(t.pcs, id)
+	delete(t.sessions, id)
+	delete(t.usage, id)
+	return pc, sess
+}
+
+// ids 所有有连接的客户端, 排序后返回
+func (t *peerTable) ids() []string {
+	t.mu.Lock()
+	ids := make([]string, 0, len(t.pcs))
+	for id := range t.pcs {
+		ids = append(ids, id)
+	}
+	t.mu.Unlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// sessionIDs 通过信令建立会话的客户端, 排序后返回
+func (t *peerTable) sessionIDs() []string {
+	t.mu.Lock()
+	ids := make([]string, 0, len(t.sessions))
+	for id := range t.sessions {
+		ids = append(ids, id)
+	}
+	t.mu.Unlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// peerConnections 所有客户端当前的 pc
+func (t *peerTable) peerConnections() map[*webrtc.PeerConnection]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := make(map[*webrtc.PeerConnection]bool, len(t.pcs))
+	for _, pc := range t.pcs {
+		current[pc] = true
+	}
+	return current
+}
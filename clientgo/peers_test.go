@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clientgo/signal"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// setLimit 测试期间修改资源上限, 返回恢复的函数
+func setLimit(limit *int, value int) func() {
+	old := *limit
+	*limit = value
+	return func() { *limit = old }
+}
+
+// testSession 只用作 peerTable 中的标识, 不建立连接
+func testSession(id string) *session {
+	return newSession(id, &signal.ConnectRequest{Action: signal.ActionPullFromStream})
+}
+
+// 同一个客户端的 askToConnect 同时到达时只创建一个会话
+func TestPeerTableGetOrCreateSameClient(t *testing.T) {
+	table := newPeerTable()
+	var calls, created int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := table.getOrCreate("c1", usage{}, func() (*webrtc.PeerConnection, *session, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(10 * time.Millisecond)
+				return new(webrtc.PeerConnection), testSession("c1"), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("create called %d times, want 1", calls)
+	}
+	if created != 1 {
+		t.Errorf("%d calls created the session, want 1", created)
+	}
+	if pc, sess := table.get("c1"); pc == nil || sess == nil {
+		t.Errorf("session of c1 not stored")
+	}
+}
+
+// 创建失败时等待的请求收到同一个错误, 资源被释放
+func TestPeerTableGetOrCreateFailure(t *testing.T) {
+	table := newPeerTable()
+	failed := fmt.Errorf("create failed")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := table.getOrCreate("c1", usage{}, func() (*webrtc.PeerConnection, *session, error) {
+				time.Sleep(10 * time.Millisecond)
+				return nil, nil, failed
+			})
+			if ok || (err != nil && err != failed) {
+				t.Errorf("getOrCreate = %v, %v", ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if pc := table.peerConnection("c1"); pc != nil {
+		t.Errorf("failed session stored")
+	}
+	if len(table.usage) != 0 {
+		t.Errorf("usage of the failed session kept: %v", table.usage)
+	}
+}
+
+func TestPeerTableGetOrCreateLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit *int
+		usage usage
+	}{
+		{"sessions", maxSessions, usage{}},
+		{"publishers", maxPublishers, usage{publisher: true}},
+		{"viewers per stream", maxViewersPerStream, usage{streams: []string{"cam1"}}},
+		{"file playbacks", maxFilePlaybacks, usage{files: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setLimit(test.limit, 5)()
+			table := newPeerTable()
+			var created, limited int32
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				id := fmt.Sprintf("c%d", i)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, err := table.getOrCreate(id, test.usage, func() (*webrtc.PeerConnection, *session, error) {
+						return new(webrtc.PeerConnection), testSession(id), nil
+					})
+					switch {
+					case ok:
+						atomic.AddInt32(&created, 1)
+					case signal.CodeOf(err) == signal.CodeLimitExceeded:
+						atomic.AddInt32(&limited, 1)
+					default:
+						t.Errorf("getOrCreate(%s) = %v, %v", id, ok, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if created != 5 || limited != 45 {
+				t.Errorf("created %d and limited %d sessions, want 5 and 45", created, limited)
+			}
+		})
+	}
+}
+
+// 添加、替换、删除和检查并发进行时连接数不超过上限, 每个连接都有占用记录
+func TestPeerTableConcurrentAccess(t *testing.T) {
+	defer setLimit(maxSessions, 4)()
+	table := newPeerTable()
+	ids := []string{"c0", "c1", "c2", "c3", "c4", "c5", "c6", "c7"}
+
+	done := make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			table.mu.Lock()
+			if len(table.usage) > *maxSessions {
+				t.Errorf("%d sessions use resources, limit %d", len(table.usage), *maxSessions)
+			}
+			for id := range table.pcs {
+				if _, ok := table.usage[id]; !ok {
+					t.Errorf("connection of %s has no usage", id)
+				}
+			}
+			table.mu.Unlock()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := ids[(w+i)%len(ids)]
+				switch i % 6 {
+				case 0:
+					table.getOrCreate(id, usage{}, func() (*webrtc.PeerConnection, *session, error) {
+						return new(webrtc.PeerConnection), testSession(id), nil
+					})
+				case 1:
+					if _, sess := table.get(id); sess != nil {
+						table.replace(sess, new(webrtc.PeerConnection))
+					}
+				case 2:
+					table.remove(id)
+				case 3:
+					table.check(id, usage{files: 1})
+				case 4:
+					if old, err := table.updateUsage(id, usage{files: 1}); err == nil {
+						table.restoreUsage(id, old)
+					}
+				case 5:
+					table.ids()
+					table.peerConnections()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	<-checked
+
+	if len(table.pcs) != len(table.usage) || len(table.sessions) != len(table.pcs) {
+		t.Errorf("%d connections, %d sessions and %d usages", len(table.pcs), len(table.sessions), len(table.usage))
+	}
+}
+
+// 删除后被替换的会话不能再替换 pc
+func TestPeerTableReplaceAfterRemove(t *testing.T) {
+	table := newPeerTable()
+	sess := testSession("c1")
+	first := new(webrtc.PeerConnection)
+	table.getOrCreate("c1", usage{}, func() (*webrtc.PeerConnection, *session, error) {
+		return first, sess, nil
+	})
+
+	second := new(webrtc.PeerConnection)
+	if old, ok := table.replace(sess, second); !ok || old != first {
+		t.Fatalf("replace = %p, %v, want %p, true", old, ok, first)
+	}
+	if pc, _ := table.remove("c1"); pc != second {
+		t.Fatalf("remove returned %p, want %p", pc, second)
+	}
+	if _, ok := table.replace(sess, new(webrtc.PeerConnection)); ok {
+		t.Errorf("replaced the pc of a closed session")
+	}
+	if table.isCurrent("c1", second) {
+		t.Errorf("removed pc is current")
+	}
+}
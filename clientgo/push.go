@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	gst "clientgo/gstreamer-sink"
+	gstsrc "clientgo/gstreamer-src"
+	"clientgo/gsttemplate"
+	"clientgo/logging"
+	"clientgo/signal"
+
+	"github.com/pion/rtcp"
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// rtpReader 推流端的 track, 测试时可以替换为返回错误的 reader
+type rtpReader interface {
+	Read(b []byte) (int, error)
+}
+
+// rtpSink 接收推流的 RTP 包, gst.Pipeline 实现了这个接口. OnError 的回调在 sink 出错停止后调用
+type rtpSink interface {
+	Start()
+	Stop()
+	Push(buffer []byte)
+	OnError(f func(err error))
+}
+
+// newRTPSink 为推流的编码创建 sink, 默认是 gstreamer 管道. 编码配置了模板时按模板创建, 否则输出到 out
+var newRTPSink = func(params gsttemplate.Params, out gst.Output) (rtpSink, error) {
+	if t := gstTemplates.Lookup(params.Codec); t != nil {
+		return gst.NewPipelineFromTemplate(t, params)
+	}
+	return gst.NewPipeline(params.Codec, out)
+}
+
+var (
+	// gstOutputs push to rtmp 每种编码的 gstreamer 输出, 没有配置时播放
+	gstOutputs = sinkOutputs{}
+	// gstTemplates 每种编码的 gstreamer 管道模板, 优先于 gstOutputs
+	gstTemplates    gsttemplate.Config
+	gstTemplateFile = flag.String("gst-template-file", "", `JSON file of gstreamer templates, {"sink": {codec: pipeline}, "src": {codec: encoder}}, a sink template overrides -gst-output of the codec`)
+)
+
+func init() {
+	flag.Var(gstOutputs, "gst-output", "gstreamer output of a codec as codec=display, fake, udp:host:port or file:mkv|mp4|webm, codec * for the others, may be repeated")
+}
+
+// loadGSTTemplates 读取管道模板, 用编码注册的 payload type 和时钟频率展开后交给 gstreamer 解析,
+// 启动时发现模板的错误. sink 模板用于 push to rtmp, src 模板替换 gstreamer-src 的编码器
+func loadGSTTemplates(path string) error {
+	set, err := gsttemplate.Load(path)
+	if err != nil {
+		return err
+	}
+	for codec, t := range set.Sink {
+		params, ok := gsttemplate.CodecParams(codec)
+		if !ok {
+			return fmt.Errorf("unknown codec %q in %s", codec, path)
+		}
+		if err := gst.Validate(t, params); err != nil {
+			return err
+		}
+	}
+	if err := gstsrc.SetEncoders(set.Src); err != nil {
+		return err
+	}
+	gstTemplates = set.Sink
+	return nil
+}
+
+// sinkOutputs 每种编码的输出, key 为小写的编码名, "*" 为没有单独配置的编码
+type sinkOutputs map[string]gst.Output
+
+func (o sinkOutputs) String() string {
+	outputs := make([]string, 0, len(o))
+	for codec, out := range o {
+		outputs = append(outputs, codec+"="+string(out.Kind))
+	}
+	return strings.Join(outputs, ",")
+}
+
+func (o sinkOutputs) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected codec=output, got %q", value)
+	}
+	codec, spec := strings.ToLower(value[:i]), value[i+1:]
+	out, err := parseSinkOutput(spec)
+	if err != nil {
+		return err
+	}
+	if codec != "*" {
+		name := ""
+		for _, c := range defaultCodecs {
+			if strings.EqualFold(c, codec) {
+				name = c
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("unknown codec %q", value[:i])
+		}
+		// 文件名在创建管道时才确定, 这里只检查编码和容器
+		check := out
+		if check.Kind == gst.OutputFile {
+			check.Location = "check." + check.Container
+		}
+		if _, err := gst.Describe(name, check); err != nil {
+			return err
+		}
+	}
+	o[codec] = out
+	return nil
+}
+
+// parseSinkOutput 解析 display, fake, udp:host:port 或 file:容器
+func parseSinkOutput(spec string) (gst.Output, error) {
+	switch {
+	case spec == string(gst.OutputDisplay):
+		return gst.Output{Kind: gst.OutputDisplay}, nil
+	case spec == string(gst.OutputFake):
+		return gst.Output{Kind: gst.OutputFake}, nil
+	case strings.HasPrefix(spec, "udp:"):
+		host, port, err := net.SplitHostPort(spec[len("udp:"):])
+		if err != nil {
+			return gst.Output{}, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return gst.Output{}, fmt.Errorf("invalid udp port %q", port)
+		}
+		return gst.Output{Kind: gst.OutputUDP, Host: host, Port: p}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return gst.Output{Kind: gst.OutputFile, Container: spec[len("file:"):]}, nil
+	}
+	return gst.Output{}, fmt.Errorf("unknown gstreamer output %q", spec)
+}
+
+// output 编码的输出, 文件保存为 gst-客户端ID-ssrc.容器, 每个 track 一个文件
+func (o sinkOutputs) output(codecName, clientID string, ssrc uint32) gst.Output {
+	out, ok := o[strings.ToLower(codecName)]
+	if !ok {
+		out = o["*"]
+	}
+	if out.Kind == "" {
+		out.Kind = gst.OutputDisplay
+	}
+	if out.Kind == gst.OutputFile {
+		out.Location = fmt.Sprintf("gst-%s-%d.%s", clientID, ssrc, out.Container)
+	}
+	return out
+}
+
+// pushToRTMP 接收推流交给 gstreamer 处理, 出错时只关闭这个客户端的连接
+func pushToRTMP(peerConnection *webrtc.PeerConnection, clientID string) error {
+	// Allow us to receive 1 audio track, and 2 video tracks
+	if err := receiveTracks(peerConnection, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	pushTracksToPipeline(peerConnection, clientID)
+	return nil
+}
+
+// pushTracksToPipeline 收到的每个 track 交给一个 gstreamer 管道
+func pushTracksToPipeline(peerConnection *webrtc.PeerConnection, clientID string) {
+	feedback := newBandwidthFeedback(peerConnection, "")
+	peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		if !beginMediaTask() {
+			return
+		}
+		defer mediaTasks.Done()
+		log := clientLogger(clientID, signal.ActionPushToRTMP).With("ssrc", track.SSRC())
+		go requestKeyframes(peerConnection, track.SSRC(), log)
+		feedback.add(track.SSRC())
+		defer feedback.remove(track.SSRC())
+
+		codec := track.Codec()
+		params := gsttemplate.Params{Codec: codec.Name, PayloadType: track.PayloadType(), ClockRate: codec.ClockRate}
+		out := gstOutputs.output(codec.Name, clientID, track.SSRC())
+		if gstTemplates.Lookup(codec.Name) != nil {
+			log.Info("开始接收 track", "payloadType", track.PayloadType(), "codec", codec.Name, "output", "template")
+		} else {
+			log.Info("开始接收 track", "payloadType", track.PayloadType(), "codec", codec.Name, "output", out.Kind)
+			if out.Location != "" {
+				log.Info("保存到文件", "file", out.Location)
+			}
+		}
+		forwardTrack(peerConnection, clientID, params, out, newMeteredReader(peerConnection, track, feedback), log)
+	})
+}
+
+// forwardTrack 为 track 创建 sink 并转发, 直到 track 结束. 创建 sink、读取和 sink 出错或者 panic 时
+// 只关闭这个客户端的连接
+func forwardTrack(peerConnection *webrtc.PeerConnection, clientID string, params gsttemplate.Params, out gst.Output, track rtpReader, log *logging.Logger) {
+	defer recoverSession(peerConnection, clientID)
+	sink, err := newRTPSink(params, out)
+	if err != nil {
+		closeSessionWithError(peerConnection, clientID, err)
+		return
+	}
+	// 管道出错时只关闭这个客户端的连接
+	sink.OnError(func(err error) {
+		closeSessionWithError(peerConnection, clientID, err)
+	})
+	sink.Start()
+	defer sink.Stop()
+	if err := forwardRTP(track, sink, log); err != nil {
+		closeSessionWithError(peerConnection, clientID, err)
+	}
+}
+
+// forwardRTP 把 track 的包推给 sink, 直到读取出错; 连接关闭时返回 nil. debug 级别时记录每个包
+func forwardRTP(track rtpReader, sink rtpSink, log *logging.Logger) error {
+	buf := make([]byte, 1400)
+	for {
+		i, err := track.Read(buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if log.Enabled(logging.Debug) {
+			log.Debug("收到 RTP 包", "size", i)
+		}
+		sink.Push(buf[:i])
+	}
+}
+
+// requestKeyframes 定时发送 PLI, 推流端每 3 秒发送一个关键帧, 连接关闭后停止
+func requestKeyframes(peerConnection *webrtc.PeerConnection, ssrc uint32, log *logging.Logger) {
+	ticker := time.NewTicker(time.Second * 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+		if errSend != nil {
+			// 连接已关闭
+			log.Debug("停止发送 PLI", "error", errSend)
+			return
+		}
+	}
+}
+
+// closeSessionWithError 关闭出错的连接并通知客户端, 设备继续服务其他客户端
+//
+// 连接已经关闭, 或者重新协商后已经被替换时不再通知
+func closeSessionWithError(peerConnection *webrtc.PeerConnection, clientID string, err error) {
+	if !peers.isCurrent(clientID, peerConnection) {
+		peerConnection.Close()
+		return
+	}
+	notify := channelSession(clientID)
+	if !closePeerConnection(clientID) {
+		return
+	}
+	logger.Error("客户端出错, 关闭连接", "client", clientID, "error", err)
+	if notify {
+		emitError(err, clientID)
+	}
+}
+
+// recoverSession 在处理推流的 goroutine 中 defer 调用, panic 时只关闭这个客户端的连接
+func recoverSession(peerConnection *webrtc.PeerConnection, clientID string) {
+	if e := recover(); e != nil {
+		closeSessionWithError(peerConnection, clientID, fmt.Errorf("run time panic: %v", e))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	gst "clientgo/gstreamer-sink"
+	"clientgo/gsttemplate"
+	"clientgo/signal"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// fakeSignaling 记录设备主动发送给客户端的消息
+type fakeSignaling struct {
+	mu       sync.Mutex
+	messages []signal.Message
+}
+
+func (f *fakeSignaling) Emit(method string, args interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if msg, ok := args.(signal.Message); ok {
+		f.messages = append(f.messages, msg)
+	}
+	return nil
+}
+
+// sentTo 发送给 clientID 的消息
+func (f *fakeSignaling) sentTo(clientID string) []signal.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var sent []signal.Message
+	for _, msg := range f.messages {
+		if msg.To == clientID {
+			sent = append(sent, msg)
+		}
+	}
+	return sent
+}
+
+// fakeReader 返回 RTP 包直到客户端的会话关闭, err 不为 nil 时第一次读取就返回 err
+type fakeReader struct {
+	clientID string
+	pc       *webrtc.PeerConnection
+	err      error
+}
+
+func (r *fakeReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !peers.isCurrent(r.clientID, r.pc) {
+		return 0, io.EOF
+	}
+	time.Sleep(time.Millisecond)
+	return copy(b, []byte{0x80, 0x60, 0, 1}), nil
+}
+
+// fakeSink 记录 Start 和 Stop, 按配置在 Push 时 panic 或者像出错的管道一样调用 OnError
+type fakeSink struct {
+	mu      sync.Mutex
+	panics  bool
+	fails   bool
+	onError func(error)
+	failed  bool
+	started bool
+	stopped bool
+}
+
+func (s *fakeSink) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+}
+
+func (s *fakeSink) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+}
+
+func (s *fakeSink) OnError(f func(err error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onError = f
+}
+
+func (s *fakeSink) Push(buffer []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.panics {
+		panic("sink broken")
+	}
+	if s.fails && !s.failed {
+		s.failed = true
+		// 管道在自己的线程上报错误
+		go s.onError(errors.New("gst: internal data stream error"))
+	}
+}
+
+// startTestSession 注册一个 push to rtmp 的会话, pc 是真实的 PeerConnection
+func startTestSession(t *testing.T, clientID string) *webrtc.PeerConnection {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	created, err := peers.getOrCreate(clientID, usage{publisher: true}, func() (*webrtc.PeerConnection, *session, error) {
+		sess := newSession(clientID, &signal.ConnectRequest{Action: signal.ActionPushToRTMP})
+		sess.channel = true
+		return pc, sess, nil
+	})
+	if err != nil || !created {
+		t.Fatalf("getOrCreate(%s) = %v, %v", clientID, created, err)
+	}
+	return pc
+}
+
+// 一个推流 track 出错时只关闭这个客户端的会话, 其他会话和设备继续运行
+func TestForwardTrackClosesOnlyFailingSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		readErr error
+		sinkErr error
+		sink    *fakeSink
+	}{
+		{name: "read error", readErr: errors.New("srtp: failed to decrypt"), sink: &fakeSink{}},
+		{name: "sink error", sinkErr: errors.New("gst: no element vp8dec")},
+		{name: "panic", sink: &fakeSink{panics: true}},
+		{name: "pipeline error", sink: &fakeSink{fails: true}},
+	}
+
+	signaling := &fakeSignaling{}
+	oldClient, oldNewRTPSink := client, newRTPSink
+	client = signaling
+	defer func() { client, newRTPSink = oldClient, oldNewRTPSink }()
+
+	healthyPC := startTestSession(t, "healthy")
+	defer closePeerConnection("healthy")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newRTPSink = func(gsttemplate.Params, gst.Output) (rtpSink, error) {
+				if test.sinkErr != nil {
+					return nil, test.sinkErr
+				}
+				return test.sink, nil
+			}
+			failingPC := startTestSession(t, "failing")
+			defer closePeerConnection("failing")
+
+			params := gsttemplate.Params{Codec: webrtc.VP8, PayloadType: webrtc.DefaultPayloadTypeVP8, ClockRate: videoClockRate}
+			reader := &fakeReader{clientID: "failing", pc: failingPC, err: test.readErr}
+			forwardTrack(failingPC, "failing", params, gst.Output{}, reader, logger)
+
+			if pc := peers.peerConnection("failing"); pc != nil {
+				t.Errorf("failing session was not closed")
+			}
+			if test.sink != nil {
+				test.sink.mu.Lock()
+				if !test.sink.started || !test.sink.stopped {
+					t.Errorf("sink started %v, stopped %v", test.sink.started, test.sink.stopped)
+				}
+				test.sink.mu.Unlock()
+			}
+
+			// 管道的错误在另一个 goroutine 中通知
+			deadline := time.Now().Add(time.Second)
+			for len(signaling.sentTo("failing")) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			sent := signaling.sentTo("failing")
+			if len(sent) != 1 || sent[0].Type != "error" {
+				t.Errorf("failing client received %+v, want one error", sent)
+			}
+			signaling.mu.Lock()
+			signaling.messages = nil
+			signaling.mu.Unlock()
+
+			if peers.peerConnection("healthy") != healthyPC {
+				t.Fatalf("healthy session was closed")
+			}
+			if _, err := healthyPC.CreateOffer(nil); err != nil {
+				t.Errorf("healthy pc stopped working: %v", err)
+			}
+			if sent := signaling.sentTo("healthy"); len(sent) != 0 {
+				t.Errorf("healthy client received %+v", sent)
+			}
+		})
+	}
+}
+
+// track 正常结束时不关闭会话, 不通知客户端
+func TestForwardTrackEndsWithoutError(t *testing.T) {
+	signaling := &fakeSignaling{}
+	oldClient, oldNewRTPSink := client, newRTPSink
+	client = signaling
+	defer func() { client, newRTPSink = oldClient, oldNewRTPSink }()
+
+	sink := &fakeSink{}
+	newRTPSink = func(gsttemplate.Params, gst.Output) (rtpSink, error) {
+		return sink, nil
+	}
+	pc := startTestSession(t, "publisher")
+	defer closePeerConnection("publisher")
+
+	params := gsttemplate.Params{Codec: webrtc.Opus, PayloadType: webrtc.DefaultPayloadTypeOpus, ClockRate: audioClockRate}
+	forwardTrack(pc, "publisher", params, gst.Output{}, &fakeReader{clientID: "publisher", pc: pc, err: io.EOF}, logger)
+
+	if peers.peerConnection("publisher") != pc {
+		t.Errorf("session closed after the track ended")
+	}
+	if !sink.stopped {
+		t.Errorf("sink not stopped")
+	}
+	if sent := signaling.sentTo("publisher"); len(sent) != 0 {
+		t.Errorf("client received %+v", sent)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"clientgo/backoff"
+	"clientgo/signal"
+)
+
+var (
+	// 连接信令服务失败或者断开后, 重连的间隔从 reconnect-min 开始加倍, 最长 reconnect-max
+	reconnectMin = flag.Duration("reconnect-min", time.Second, "first delay before reconnecting to the signaling server, doubled after every failure")
+	reconnectMax = flag.Duration("reconnect-max", 30*time.Second, "longest delay before reconnecting to the signaling server")
+
+	errSignalingOffline = errors.New("signaling server is not connected")
+)
+
+const (
+	// joinRetryInterval 没有收到 created 时重新加入房间的间隔
+	joinRetryInterval = 3 * time.Second
+	// maxQueuedMessages 断线期间最多缓存的消息, 超过时丢弃最早的
+	maxQueuedMessages = 256
+)
+
+// signalingConn 一次信令连接, socket.io 或原生 WebSocket
+type signalingConn interface {
+	signalingClient
+	Close() error
+}
+
+// signalingDialer 建立信令连接, 连接的事件交给 link 处理
+type signalingDialer func(url string, l *signalingLink) (signalingConn, error)
+
+// reconnector 管理设备和信令服务的连接
+//
+// 断开后按 backoff 重连, 重连期间已经建立的会话不关闭, 发给浏览器的消息先缓存,
+// 重新加入房间后发送缓存的消息, 然后给每个会话的浏览器发送 resume 消息,
+// 浏览器收到后重新发送断线期间没有送达的 candidate
+type reconnector struct {
+	url     string
+	dial    signalingDialer
+	backoff *backoff.Backoff
+
+	mu     sync.Mutex
+	link   *signalingLink
+	queue  []queuedMessage
+	joined bool // 至少加入过一次房间, 之后的加入为断线恢复
+}
+
+type queuedMessage struct {
+	method string
+	args   interface{}
+}
+
+// signalingLink 一次连接的状态. 每次重连创建新的 link, 旧连接迟到的事件被忽略
+type signalingLink struct {
+	r *reconnector
+
+	// 以下字段由 r.mu 保护
+	conn      signalingConn
+	emitter   signalingClient
+	joined    bool
+	down      bool
+	joinTimer *time.Timer
+}
+
+func newReconnector(url string, dial signalingDialer) *reconnector {
+	return &reconnector{
+		url:     url,
+		dial:    dial,
+		backoff: backoff.New(*reconnectMin, *reconnectMax),
+	}
+}
+
+// connect 建立新的连接, 失败时按 backoff 重试
+func (r *reconnector) connect() {
+	l := &signalingLink{r: r}
+	r.mu.Lock()
+	r.link = l
+	r.mu.Unlock()
+
+	conn, err := r.dial(r.url, l)
+	if err != nil {
+		delay := r.backoff.Next()
+		logger.Warn("连接信令服务失败, 请先启动channel服务", "url", r.url, "error", err, "attempt", r.backoff.Attempt(), "retry", delay)
+		time.AfterFunc(delay, r.connect)
+		return
+	}
+	r.mu.Lock()
+	l.conn = conn
+	down := l.down
+	r.mu.Unlock()
+	if down {
+		// 连接在 dial 返回前已经断开
+		conn.Close()
+	}
+}
+
+// Emit 已加入房间时直接发送. 断线期间缓存发给浏览器的消息, 统计消息过时后没有意义, 直接丢弃
+func (r *reconnector) Emit(method string, args interface{}) error {
+	r.mu.Lock()
+	l := r.link
+	if l != nil && l.joined && !l.down {
+		emitter := l.emitter
+		r.mu.Unlock()
+		return emitter.Emit(method, args)
+	}
+	defer r.mu.Unlock()
+	if msg, ok := args.(signal.Message); ok && msg.Type == "stats" {
+		return errSignalingOffline
+	}
+	if len(r.queue) >= maxQueuedMessages {
+		r.queue = r.queue[1:]
+	}
+	r.queue = append(r.queue, queuedMessage{method, args})
+	return nil
+}
+
+// current 是否为当前的连接, 需要持有 r.mu
+func (l *signalingLink) current() bool {
+	return l.r.link == l && !l.down
+}
+
+// onConnected 连接建立, 加入设备的房间, 没有收到 created 时定时重试
+func (l *signalingLink) onConnected(emitter signalingClient) {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	if !l.current() {
+		return
+	}
+	logger.Info("信令服务已连接")
+	l.emitter = emitter
+	l.join()
+}
+
+// join 需要持有 r.mu
+func (l *signalingLink) join() {
+	if !l.current() || l.joined {
+		return
+	}
+	l.emitter.Emit("createOrJoin", mac)
+	l.joinTimer = time.AfterFunc(joinRetryInterval, func() {
+		l.r.mu.Lock()
+		defer l.r.mu.Unlock()
+		l.join()
+	})
+}
+
+// onCreated 已加入房间, 发送断线期间缓存的消息, 通知会话的浏览器恢复
+func (l *signalingLink) onCreated(room string) {
+	r := l.r
+	r.mu.Lock()
+	if !l.current() || l.joined {
+		r.mu.Unlock()
+		return
+	}
+	logger.Info("房间已创建", "room", room)
+	l.joined = true
+	if l.joinTimer != nil {
+		l.joinTimer.Stop()
+	}
+	r.backoff.Reset()
+	resumed := r.joined
+	r.joined = true
+	queue := r.queue
+	r.queue = nil
+	emitter := l.emitter
+	r.mu.Unlock()
+
+	for _, m := range queue {
+		emitter.Emit(m.method, m.args)
+	}
+	if !resumed {
+		return
+	}
+	ids := peers.sessionIDs()
+	logger.Info("信令服务已恢复", "sessions", len(ids), "queued", len(queue))
+	for _, id := range ids {
+		emitter.Emit("messageToBrowser", signal.Message{Type: "resume", From: mac, To: id})
+	}
+}
+
+// onDisconnected 连接断开, 保留已经建立的会话, 按 backoff 重连
+func (l *signalingLink) onDisconnected(err error) {
+	r := l.r
+	r.mu.Lock()
+	if !l.current() {
+		r.mu.Unlock()
+		return
+	}
+	l.down = true
+	if l.joinTimer != nil {
+		l.joinTimer.Stop()
+	}
+	conn := l.conn
+	r.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	kept := len(peers.sessionIDs())
+	delay := r.backoff.Next()
+	logger.Warn("信令服务连接断开", "error", err, "sessions", kept, "retry", delay)
+	time.AfterFunc(delay, r.connect)
+}
+
+// onAskToConnect 客户端请求建立连接
+func (l *signalingLink) onAskToConnect(msg signal.Message) {
+	l.r.Emit("messageToBrowser", handleConnect(msg, true))
+}
+
+// onMessageToDevice 客户端发来的 offer, answer, candidate 和 renegotiate
+func (l *signalingLink) onMessageToDevice(msg signal.Message) {
+	if reply := handleMessage(msg); reply != nil {
+		l.r.Emit("messageToBrowser", reply)
+	}
+}
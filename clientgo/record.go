@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+	media "github.com/pion/webrtc/v2/pkg/media"
+)
+
+var (
+	// recordings 正在保存的推流, key 为客户端 ID
+	recordings     = make(map[string]*recorder)
+	recordingsLock sync.Mutex
+)
+
+// recorder 保存推流的视频文件, 停止保存后推流继续分发给拉流端
+type recorder struct {
+	clientID string
+	file     string
+
+	mu      sync.Mutex
+	writer  media.Writer
+	stopped bool
+}
+
+// startRecording 记录客户端正在保存的文件
+func startRecording(clientID, file string, writer media.Writer) *recorder {
+	r := &recorder{clientID: clientID, file: file, writer: writer}
+	recordingsLock.Lock()
+	recordings[clientID] = r
+	recordingsLock.Unlock()
+	return r
+}
+
+// stopRecording 停止保存客户端的推流, 没有正在保存的文件时返回 false.
+// 停止后 recorder 留到会话关闭, ICE 重启和重新协商后也不再保存
+func stopRecording(clientID string) bool {
+	recordingsLock.Lock()
+	r := recordings[clientID]
+	recordingsLock.Unlock()
+	if r == nil {
+		return false
+	}
+	return r.stop()
+}
+
+// closeRecording 会话关闭, 关闭客户端的文件
+func closeRecording(clientID string) {
+	if r := activeRecording(clientID); r != nil {
+		r.Close()
+	}
+}
+
+// activeRecording 客户端的 recorder, 包括已经停止保存的, 没有时为 nil
+func activeRecording(clientID string) *recorder {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+	return recordings[clientID]
+}
+
+// recordingFile 客户端正在保存的文件, 没有时为空
+func recordingFile(clientID string) string {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+	if r := recordings[clientID]; r != nil && !r.isStopped() {
+		return r.file
+	}
+	return ""
+}
+
+// WriteRTP 停止保存后丢弃收到的包. 写入出错时停止保存并关闭文件, 和 stopRecording 一样
+// recorder 留到会话关闭, ICE 重启和重新协商后的 track 也不再写入这个文件
+func (r *recorder) WriteRTP(packet *rtp.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil
+	}
+	if err := r.writer.WriteRTP(packet); err != nil {
+		r.stopLocked()
+		return err
+	}
+	return nil
+}
+
+// recordingTrack 一个推流 track 写入 recorder
+//
+// 信令建立的会话 ICE 重启或重新协商时, 旧的 track 结束后会话还在, 不关闭文件,
+// 新的 pc 的 track 继续写入同一个文件, 会话关闭时由 closePeerConnection 停止保存
+type recordingTrack struct {
+	*recorder
+}
+
+// Close track 正常结束, 会话已经关闭或者不能重新协商时关闭文件. 写入出错时 WriteRTP 已经停止保存
+func (t recordingTrack) Close() error {
+	if peers.session(t.clientID) != nil {
+		return nil
+	}
+	return t.recorder.Close()
+}
+
+// Close 停止保存并关闭文件, 可以多次调用
+func (r *recorder) Close() error {
+	recordingsLock.Lock()
+	if recordings[r.clientID] == r {
+		delete(recordings, r.clientID)
+	}
+	recordingsLock.Unlock()
+	r.stop()
+	return nil
+}
+
+func (r *recorder) isStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped
+}
+
+// stop 停止保存并关闭文件, 已经停止时返回 false
+func (r *recorder) stop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopLocked()
+}
+
+func (r *recorder) stopLocked() bool {
+	if r.stopped {
+		return false
+	}
+	r.stopped = true
+	if err := r.writer.Close(); err != nil {
+		logger.Warn("关闭视频文件出错", "client", r.clientID, "file", r.file, "error", err)
+	}
+	return true
+}
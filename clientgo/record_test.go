@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// failingWriter 第 failAt 次写入开始返回错误, 记录写入和关闭的次数
+type failingWriter struct {
+	mu     sync.Mutex
+	failAt int
+	writes int
+	closed int
+}
+
+func (w *failingWriter) WriteRTP(*rtp.Packet) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	if w.writes >= w.failAt {
+		return errors.New("write output.ivf: no space left on device")
+	}
+	return nil
+}
+
+func (w *failingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed++
+	return nil
+}
+
+// packetReader 返回 count 个 RTP 包后结束
+type packetReader struct {
+	count int
+	seq   uint16
+}
+
+func (r *packetReader) Read(b []byte) (int, error) {
+	if r.count == 0 {
+		return 0, io.EOF
+	}
+	r.count--
+	r.seq++
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: r.seq}, Payload: []byte{1, 2, 3}}
+	raw, err := packet.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, raw), nil
+}
+
+// countingTrack 记录转发给直播流的包
+type countingTrack struct {
+	packets int
+}
+
+func (t *countingTrack) WriteRTP(*rtp.Packet) error {
+	t.packets++
+	return nil
+}
+
+// 写入出错后不再保存, ICE 重启后新的 track 也不再写入同一个文件, 直播流继续分发
+func TestRecordingStopsAfterWriteError(t *testing.T) {
+	startTestSession(t, "recorder")
+	defer closePeerConnection("recorder")
+
+	w := &failingWriter{failAt: 3}
+	r := startRecording("recorder", "output-recorder.ivf", w)
+
+	live := &countingTrack{}
+	saveToDiskAndAddtoLocaltrack(recordingTrack{r}, &packetReader{count: 10}, live, logger)
+	if live.packets != 10 {
+		t.Errorf("forwarded %d packets, want 10", live.packets)
+	}
+	if w.writes != 3 || w.closed != 1 {
+		t.Errorf("file written %d times and closed %d times, want 3 and 1", w.writes, w.closed)
+	}
+	if file := recordingFile("recorder"); file != "" {
+		t.Errorf("still recording to %s", file)
+	}
+
+	// ICE 重启后新的 pc 的 track 使用同一个 recorder
+	restarted := activeRecording("recorder")
+	if restarted == nil {
+		t.Fatal("recorder dropped before the session closed")
+	}
+	live = &countingTrack{}
+	saveToDiskAndAddtoLocaltrack(recordingTrack{restarted}, &packetReader{count: 10}, live, logger)
+	if live.packets != 10 {
+		t.Errorf("forwarded %d packets after the restart, want 10", live.packets)
+	}
+	if w.writes != 3 || w.closed != 1 {
+		t.Errorf("file written %d times and closed %d times after the restart, want 3 and 1", w.writes, w.closed)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"clientgo/signal"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// vp8FrameTicks 切换 layer 时两帧之间的时间戳间隔, 90kHz 下约 30fps
+const vp8FrameTicks = 3000
+
+// viewerMode 拉流端带宽不够最低的一层时, 只转发关键帧或暂停视频, 音频不受影响
+type viewerMode int
+
+const (
+	modeNormal viewerMode = iota
+	modeKeyframes
+	modePaused
+)
+
+func (m viewerMode) String() string {
+	switch m {
+	case modeKeyframes:
+		return "keyframes"
+	case modePaused:
+		return "paused"
+	}
+	return "normal"
+}
+
+const (
+	// 带宽不低于最低一层码率的 keyframesRatio 时只转发关键帧, 否则暂停视频
+	keyframesRatio = 0.25
+	// 拉流端丢包率高于 highLoss 时降低带宽估计, 低于 lowLoss 时提高
+	highLoss = 0.1
+	lowLoss  = 0.02
+	// lossIncrease 没有丢包时每个 RR 提高带宽估计的比例
+	lossIncrease = 1.08
+)
+
+// viewer 一个拉流端
+//
+// 不同 layer 的 SSRC, 序号和时间戳互不相关, 转发时改写成拉流端 track 自己的,
+// 切换 layer 后浏览器看到的仍然是连续的一路视频.
+// 拉流端的 RTCP (RR 的丢包率和 REMB) 用来估计它的可用带宽, 按带宽选择 layer
+type viewer struct {
+	// clientID 拉流的客户端, 用于管理接口
+	clientID string
+	track    *webrtc.Track
+	// audio 转发推流端的音频, 拉流端没有协商 opus 时为 nil
+	audio *webrtc.Track
+	// 发送的 track 的 SR, 没有音频时 audioReport 为 nil
+	videoReport, audioReport *senderReporter
+
+	mu      sync.Mutex
+	quality string
+	// bandwidth 请求的带宽, bps, 0 表示不限制
+	bandwidth int
+	// current 正在转发的 layer, target 要切换到的 layer, 收到 target 的关键帧后切换
+	current, target string
+	mode            viewerMode
+	// keyframeTS 只转发关键帧时正在转发的关键帧的时间戳
+	keyframeTS    uint32
+	sendKeyframe  bool
+	started       bool
+	seq, audioSeq uint16
+	tsOffset      uint32
+	lastTS        uint32
+
+	// 发送码率, 每秒统计一次
+	sentBytes   int
+	windowStart time.Time
+	sentRate    int
+	// lossEstimate 按 RR 丢包率估计的带宽, remb 拉流端 REMB 的带宽, 0 表示没有反馈
+	lossEstimate int
+	remb         int
+}
+
+func newViewer(track, audio *webrtc.Track, quality string, bandwidth int) *viewer {
+	v := &viewer{
+		track:       track,
+		audio:       audio,
+		videoReport: newSenderReporter(track.SSRC(), signal.KindVideo, webrtc.VP8, videoClockRate),
+		quality:     quality,
+		bandwidth:   bandwidth * 1000,
+		seq:         uint16(rand.Uint32()),
+		audioSeq:    uint16(rand.Uint32()),
+		windowStart: time.Now(),
+	}
+	if audio != nil {
+		v.audioReport = newSenderReporter(audio.SSRC(), signal.KindAudio, webrtc.Opus, audioClockRate)
+	}
+	return v
+}
+
+// request 返回请求的画质和可用带宽 (bps), 可用带宽是请求的带宽和估计的带宽中较小的
+func (v *viewer) request() (string, int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	available := v.bandwidth
+	for _, estimate := range []int{v.lossEstimate, v.remb} {
+		if estimate > 0 && (available == 0 || estimate < available) {
+			available = estimate
+		}
+	}
+	return v.quality, available
+}
+
+// setTarget 设置要切换到的 layer 和模式, 返回是否需要请求关键帧
+func (v *viewer) setTarget(quality string, mode viewerMode) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	changed := v.target != quality
+	v.target = quality
+	if v.mode != mode {
+		if v.mode != modeNormal {
+			// 之前的帧没有全部转发, 从关键帧重新开始
+			v.current = ""
+			changed = true
+		}
+		v.mode = mode
+		v.sendKeyframe = false
+	}
+	return changed
+}
+
+// resync 推流端重新推 quality 层, 从新的关键帧开始转发
+func (v *viewer) resync(quality string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.current == quality {
+		v.current = ""
+	}
+}
+
+// forward 转发 layer 的包, mapping 为推流端的时间戳对应关系, 只返回拉流端连接关闭的错误
+func (v *viewer) forward(layer string, packet *rtp.Packet, keyframe bool, mapping clockMapping) error {
+	v.mu.Lock()
+	if !v.accept(layer, packet, keyframe) {
+		v.mu.Unlock()
+		return nil
+	}
+	out := *packet
+	out.SSRC = v.track.SSRC()
+	out.PayloadType = v.track.PayloadType()
+	v.seq++
+	out.SequenceNumber = v.seq
+	out.Timestamp = packet.Timestamp + v.tsOffset
+	v.lastTS = out.Timestamp
+	v.started = true
+	v.count(len(packet.Payload))
+	mapping.rtp += v.tsOffset
+	v.videoReport.onPacket(&out, mapping)
+	v.mu.Unlock()
+
+	if err := v.track.WriteRTP(&out); err == io.ErrClosedPipe {
+		return err
+	}
+	return nil
+}
+
+// accept 是否转发 layer 的包, 调用时需要持有 v.mu
+func (v *viewer) accept(layer string, packet *rtp.Packet, keyframe bool) bool {
+	if v.mode == modePaused {
+		return false
+	}
+	if layer == v.target && layer != v.current && keyframe {
+		v.current = layer
+		v.tsOffset = 0
+		if v.started {
+			v.tsOffset = v.lastTS + vp8FrameTicks - packet.Timestamp
+		}
+	}
+	if layer != v.current {
+		return false
+	}
+	if v.mode == modeKeyframes {
+		// 只转发关键帧的所有包
+		if keyframe {
+			v.keyframeTS = packet.Timestamp
+			v.sendKeyframe = true
+		}
+		return v.sendKeyframe && packet.Timestamp == v.keyframeTS
+	}
+	return true
+}
+
+// count 统计发送码率, 调用时需要持有 v.mu
+func (v *viewer) count(n int) {
+	v.sentBytes += n
+	elapsed := time.Since(v.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+	v.sentRate = int(float64(v.sentBytes*8) / elapsed.Seconds())
+	v.sentBytes = 0
+	v.windowStart = time.Now()
+}
+
+// forwardAudio 转发推流端的音频, 音频的时间戳不变
+func (v *viewer) forwardAudio(packet *rtp.Packet, mapping clockMapping) error {
+	if v.audio == nil {
+		return nil
+	}
+	v.mu.Lock()
+	out := *packet
+	out.SSRC = v.audio.SSRC()
+	out.PayloadType = v.audio.PayloadType()
+	v.audioSeq++
+	out.SequenceNumber = v.audioSeq
+	v.mu.Unlock()
+	v.audioReport.onPacket(&out, mapping)
+
+	if err := v.audio.WriteRTP(&out); err == io.ErrClosedPipe {
+		return err
+	}
+	return nil
+}
+
+// onLoss 按 RR 的丢包率更新带宽估计, 返回估计是否变化
+func (v *viewer) onLoss(fractionLost uint8) bool {
+	loss := float64(fractionLost) / 256
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sentRate == 0 {
+		return false
+	}
+	before := v.lossEstimate
+	switch {
+	case loss > highLoss:
+		v.lossEstimate = int(float64(v.sentRate) * (1 - 0.5*loss))
+	case loss < lowLoss && v.lossEstimate > 0:
+		v.lossEstimate = int(float64(v.lossEstimate) * lossIncrease)
+		if v.lossEstimate > 2*v.sentRate && v.mode == modeNormal {
+			// 带宽已经足够, 不再按丢包限制
+			v.lossEstimate = 0
+		}
+	}
+	return v.lossEstimate != before
+}
+
+// onREMB 更新拉流端 REMB 的带宽, 返回是否变化
+func (v *viewer) onREMB(bitrate uint64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	before := v.remb
+	v.remb = int(bitrate)
+	return v.remb != before
+}
+
+// currentLayer 正在转发的 layer, 还没有开始转发时为要切换到的 layer
+func (v *viewer) currentLayer() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.current != "" {
+		return v.current
+	}
+	return v.target
+}
+
+// status 正在转发的 layer 和模式
+func (v *viewer) status() (string, viewerMode) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.current, v.mode
+}
+
+// readRTCP 读取拉流端的 RTCP, 按反馈的带宽重新选择 layer, 转发 PLI 给推流端.
+// 拉流端的连接关闭后返回
+func (s *stream) readRTCP(v *viewer, sender *webrtc.RTPSender) {
+	for {
+		packets, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		onReceiverReports(packets, v.videoReport, v.audioReport)
+		changed := false
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverReport:
+				for _, report := range p.Reports {
+					if report.SSRC == v.track.SSRC() && v.onLoss(report.FractionLost) {
+						changed = true
+					}
+				}
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				if v.onREMB(p.Bitrate) {
+					changed = true
+				}
+			case *rtcp.PictureLossIndication:
+				s.requestKeyframe(v.currentLayer())
+			}
+		}
+		if changed {
+			s.selectLayer(v)
+		}
+	}
+}
+
+// isVP8Keyframe 判断包是否是 VP8 关键帧的第一个包, 参考 RFC 7741.
+// 只在第一个包切换 layer, 不会从帧中间开始转发
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// S 位为 1 且 PID 为 0 表示一帧的第一个分区的开始
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		x := payload[1]
+		i++
+		if x&0x80 != 0 {
+			// PictureID, M 位为 1 时是 15 位
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i += 2
+			} else {
+				i++
+			}
+		}
+		if x&0x40 != 0 {
+			// TL0PICIDX
+			i++
+		}
+		if x&0x30 != 0 {
+			// TID/KEYIDX
+			i++
+		}
+	}
+	if len(payload) <= i {
+		return false
+	}
+	// VP8 帧头第一个字节的最低位为 0 表示关键帧
+	return payload[i]&0x01 == 0
+}
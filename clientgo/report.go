@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"clientgo/stats"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// senderReportInterval 发送 SR 的间隔
+const senderReportInterval = time.Second
+
+// ntpEpochOffset 1900-01-01 到 1970-01-01 的秒数
+const ntpEpochOffset = 2208988800
+
+// clockMapping RTP 时间戳和时间的对应关系, 浏览器用音视频的 SR 中的对应关系做同步
+type clockMapping struct {
+	ntp       time.Time
+	rtp       uint32
+	clockRate uint32
+}
+
+// at 返回 t 时刻对应的 RTP 时间戳
+func (m clockMapping) at(t time.Time) uint32 {
+	return m.rtp + uint32(int64(t.Sub(m.ntp))*int64(m.clockRate)/int64(time.Second))
+}
+
+// localMapping 没有推流端的 SR 时, 以发送时间作为包的时间
+func localMapping(packet *rtp.Packet, clockRate uint32) clockMapping {
+	return clockMapping{ntp: time.Now(), rtp: packet.Timestamp, clockRate: clockRate}
+}
+
+// toNTP 转换为 64 位 NTP 时间戳
+func toNTP(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// fromNTP 转换 64 位 NTP 时间戳
+func fromNTP(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+// senderReporter 统计设备发送的一个 track, 生成 SR
+type senderReporter struct {
+	ssrc  uint32
+	stats *stats.Outbound
+
+	mu      sync.Mutex
+	packets uint32
+	octets  uint32
+	mapping clockMapping
+	started bool
+}
+
+func newSenderReporter(ssrc uint32, kind, codec string, clockRate uint32) *senderReporter {
+	return &senderReporter{ssrc: ssrc, stats: stats.NewOutbound(ssrc, kind, codec, clockRate)}
+}
+
+// onPacket 记录发送的包, mapping 为包的时间戳和时间的对应关系
+func (r *senderReporter) onPacket(packet *rtp.Packet, mapping clockMapping) {
+	r.stats.OnPacket(time.Now(), packet.Timestamp, len(packet.Payload))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets++
+	r.octets += uint32(len(packet.Payload))
+	r.mapping = mapping
+	r.started = true
+}
+
+// report 返回 now 时刻的 SR 和 CNAME, 还没有发送过包时返回 nil
+//
+// RFC 3550 要求 SR 和 SDES 一起发送, pion/webrtc 也按 SDES 中的 SSRC 分发没有接收报告的 SR
+func (r *senderReporter) report(now time.Time) []rtcp.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started {
+		return nil
+	}
+	return []rtcp.Packet{
+		&rtcp.SenderReport{
+			SSRC:        r.ssrc,
+			NTPTime:     toNTP(now),
+			RTPTime:     r.mapping.at(now),
+			PacketCount: r.packets,
+			OctetCount:  r.octets,
+		},
+		&rtcp.SourceDescription{Chunks: []rtcp.SourceDescriptionChunk{{
+			Source: r.ssrc,
+			Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: mac}},
+		}}},
+	}
+}
+
+// sendReports 定时在连接上发送 SR, 连接关闭后停止
+func sendReports(peerConnection *webrtc.PeerConnection, reporters ...*senderReporter) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if peerConnection.ICEConnectionState() == webrtc.ICEConnectionStateClosed {
+			return
+		}
+		var packets []rtcp.Packet
+		for _, r := range reporters {
+			if r != nil {
+				packets = append(packets, r.report(now)...)
+			}
+		}
+		if len(packets) == 0 {
+			continue
+		}
+		if err := peerConnection.WriteRTCP(packets); err != nil {
+			// 连接已关闭
+			return
+		}
+	}
+}
+
+// readSenderReports 读取推流端 track 的 SR, 直到连接关闭
+func readSenderReports(receiver *webrtc.RTPReceiver, ssrc uint32, onReport func(*rtcp.SenderReport)) {
+	for {
+		packets, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if sr, ok := packet.(*rtcp.SenderReport); ok && sr.SSRC == ssrc {
+				onReport(sr)
+			}
+		}
+	}
+}
+
+// readReceiverReports 读取拉流端对 reporters 的 RR, 直到连接关闭
+func readReceiverReports(sender *webrtc.RTPSender, reporters ...*senderReporter) {
+	for {
+		packets, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		onReceiverReports(packets, reporters...)
+	}
+}
+
+// onReceiverReports 把 RR 中的接收报告记录到对应的 track
+func onReceiverReports(packets []rtcp.Packet, reporters ...*senderReporter) {
+	now := time.Now()
+	for _, packet := range packets {
+		rr, ok := packet.(*rtcp.ReceiverReport)
+		if !ok {
+			continue
+		}
+		for _, report := range rr.Reports {
+			for _, r := range reporters {
+				if r != nil && r.ssrc == report.SSRC {
+					r.stats.OnReceptionReport(report, now)
+				}
+			}
+		}
+	}
+}
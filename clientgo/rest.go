@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+
+	"clientgo/signal"
+)
+
+// restHandler REST 信令, 和 socket.io 的 askToConnect/messageToDevice 处理相同
+//
+// REST 客户端没有 socket.ID, 由客户端在 From 中填写自己的 ID
+type restHandler struct{}
+
+// Connect 超时后客户端收不到 ready, 关闭已经创建的会话
+func (restHandler) Connect(ctx context.Context, msg signal.Message) (signal.Message, error) {
+	reply := handleConnect(msg, false)
+	if err := ctx.Err(); err != nil {
+		if reply.Type == "ready" {
+			closePeerConnection(msg.From)
+		}
+		return signal.Message{}, err
+	}
+	return reply, nil
+}
+
+// Message 超时后客户端收不到 answer 或设备的 offer, 放弃这次协商
+func (restHandler) Message(ctx context.Context, msg signal.Message) (*signal.Message, error) {
+	reply := handleMessage(msg)
+	if err := ctx.Err(); err != nil {
+		if reply != nil && reply.Type != "error" {
+			abandonNegotiation(msg)
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// abandonNegotiation 放弃客户端收不到回复的协商, 重新协商时只关闭重新协商中的 pc,
+// 第一次协商时关闭会话
+func abandonNegotiation(msg signal.Message) {
+	sess := peers.session(msg.From)
+	if sess != nil {
+		if pending := sess.pendingPeerConnection(); pending != nil {
+			sess.dropPending(pending)
+			return
+		}
+	}
+	if msg.Type == "offer" {
+		closePeerConnection(msg.From)
+	}
+}
+
+// restServer REST 信令服务, 关闭设备时需要调用 Shutdown
+var restServer *signal.HTTPServer
+
+// serveSignalHTTP 启动 REST 信令服务
+func serveSignalHTTP() {
+	restServer = signal.NewHTTPServer(signal.HTTPOptions{
+		Addr:       *signalHTTPAddr,
+		CertFile:   *signalHTTPCert,
+		KeyFile:    *signalHTTPKey,
+		PathPrefix: *signalHTTPPrefix,
+		Timeout:    *signalHTTPTimeout,
+	}, restHandler{})
+	logger.Info("REST 信令服务启动", "addr", *signalHTTPAddr)
+	go func() {
+		if err := restServer.ListenAndServe(); err != nil {
+			logger.Error("REST 信令服务出错", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"clientgo/signal"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+var (
+	// 多久没有收到客户端的 STUN 包时认为连接断开, pion 默认 30 秒, 网络切换时太长
+	iceDisconnectedTimeout = flag.Duration("ice-disconnected-timeout", 10*time.Second, "how long a connection may stay silent before it is considered disconnected")
+	// 连接断开后等待恢复的时间, 没有恢复时设备发起 ICE 重启, 连接失败时立即重启
+	iceRestartDelay = flag.Duration("ice-restart-delay", 3*time.Second, "how long a disconnected session may recover by itself before the device restarts ICE")
+	// 从连接断开开始, ICE 重启没有在这个时间内完成时关闭会话
+	iceRestartTimeout = flag.Duration("ice-restart-timeout", 30*time.Second, "how long a session may stay disconnected while ICE restarts, the device does not restart ICE if 0")
+)
+
+// ICE 重启
+//
+// pion/webrtc v2.1.2 不支持在已有的连接上重启 ICE, 和重新协商一样由设备创建新的 pc 发送 offer,
+// track 不变, 客户端用新的 RTCPeerConnection 回复 answer, 新的 pc 连接后替换旧的 pc.
+// 推流会话的新 track 继续写入之前的文件和直播流, 拉流会话的新 pc 继续拉同一个直播流
+//
+// 客户端发送 renegotiate 消息 {"iceRestart": true} 也会收到设备的 offer
+
+// iceKeepaliveInterval 设备在选中的 candidate pair 上发送 STUN 的间隔, 需要比断开的超时短
+const iceKeepaliveInterval = 2 * time.Second
+
+// iceSettings 按 -ice-disconnected-timeout 检测断开
+func iceSettings() webrtc.SettingEngine {
+	s := webrtc.SettingEngine{}
+	s.SetConnectionTimeout(*iceDisconnectedTimeout, iceKeepaliveInterval)
+	return s
+}
+
+// onICEStateChange 会话中 pc 的连接状态变化, 当前的 pc 断开时重启 ICE
+func (s *session) onICEStateChange(peerConnection *webrtc.PeerConnection, connectionState webrtc.ICEConnectionState) {
+	switch connectionState {
+	case webrtc.ICEConnectionStateConnected:
+		s.promote(peerConnection)
+		if s.isCurrent(peerConnection) {
+			s.recovered()
+		}
+	case webrtc.ICEConnectionStateDisconnected:
+		if s.isCurrent(peerConnection) {
+			s.scheduleRestart(*iceRestartDelay)
+		}
+	case webrtc.ICEConnectionStateFailed:
+		if s.dropPending(peerConnection) {
+			if s.restarting() {
+				// 重启的 pc 也失败了, 到超时前继续重启
+				s.scheduleRestart(0)
+			} else {
+				sendErrorToClient(signal.NewError(signal.CodeInternal, "renegotiation failed"), s.id)
+			}
+		} else if s.isCurrent(peerConnection) {
+			s.scheduleRestart(0)
+		}
+	}
+}
+
+// isCurrent peerConnection 是否为会话当前的 pc
+func (s *session) isCurrent(peerConnection *webrtc.PeerConnection) bool {
+	return peers.isCurrent(s.id, peerConnection)
+}
+
+// restarting 连接断开后还没有恢复
+func (s *session) restarting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restartDeadline != nil
+}
+
+// scheduleRestart delay 后发起 ICE 重启, 已经在等待重启时不重复发起. REST 建立的会话由客户端发起重启.
+// 第一次断开时开始计时, 超过 -ice-restart-timeout 没有恢复时关闭会话
+func (s *session) scheduleRestart(delay time.Duration) {
+	if *iceRestartTimeout <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.restartTimer != nil {
+		return
+	}
+	if s.restartDeadline == nil {
+		s.log.Warn("连接断开, 等待 ICE 重启", "delay", delay, "timeout", *iceRestartTimeout)
+		s.restartDeadline = time.AfterFunc(*iceRestartTimeout, s.restartTimedOut)
+	}
+	s.restartTimer = time.AfterFunc(delay, s.restartICE)
+}
+
+// restartICE 创建新的 pc, 通过信令服务给客户端发送 offer
+func (s *session) restartICE() {
+	s.mu.Lock()
+	s.restartTimer = nil
+	closed := s.closed
+	s.mu.Unlock()
+	if closed || !s.channel {
+		// 通过 REST 建立的会话设备不能主动发送消息, 等待客户端重启
+		return
+	}
+	offer, tracks, err := s.renegotiate(&signal.Renegotiation{ICERestart: true})
+	if err != nil {
+		s.log.Warn("ICE 重启出错", "error", err)
+		return
+	}
+	key, err := sealKey(s.id)
+	if err != nil {
+		s.log.Warn("ICE 重启出错", "error", err)
+		return
+	}
+	client.Emit("messageToBrowser", deviceOffer(signal.Message{From: s.id, To: mac}, key, offer, tracks))
+}
+
+// recovered 当前的 pc 连接上了, 停止重启
+func (s *session) recovered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restartDeadline == nil {
+		return
+	}
+	s.restartDeadline.Stop()
+	s.restartDeadline = nil
+	if s.restartTimer != nil {
+		s.restartTimer.Stop()
+		s.restartTimer = nil
+	}
+	s.log.Info("连接已恢复")
+}
+
+// restartTimedOut 超时没有恢复, 关闭会话, 推流保存的文件随会话关闭
+func (s *session) restartTimedOut() {
+	s.mu.Lock()
+	if s.restartDeadline == nil || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.restartDeadline = nil
+	s.mu.Unlock()
+	if peers.session(s.id) == s {
+		s.log.Warn("ICE 重启超时, 关闭会话")
+		hangUp(s.id, "connection lost")
+	}
+}
+
+// stopRestartLocked 会话关闭时停止重启的计时, 调用时需要持有 s.mu
+func (s *session) stopRestartLocked() {
+	if s.restartTimer != nil {
+		s.restartTimer.Stop()
+		s.restartTimer = nil
+	}
+	if s.restartDeadline != nil {
+		s.restartDeadline.Stop()
+		s.restartDeadline = nil
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"clientgo/signal"
+)
+
+const (
+	sealPSK  = "psk"
+	sealECDH = "ecdh"
+)
+
+var (
+	// sharedSealKey psk 模式下所有客户端共用的密钥
+	sharedSealKey *signal.Key
+
+	// sealKeys ecdh 模式下每个客户端首次连接时协商的密钥
+	sealKeys     = make(map[string]*signal.Key)
+	sealKeysLock sync.Mutex
+
+	errMissingPublicKey = errors.New("missing ECDH public key")
+	errNoSealKey        = errors.New("no sealing key negotiated for this client")
+)
+
+// loadSealKey psk 模式读取共享密钥
+func loadSealKey(path string) error {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		return errors.New("seal key file " + path + " is empty")
+	}
+	sharedSealKey, err = signal.NewKey(secret)
+	return err
+}
+
+// negotiateSeal 建立连接时协商客户端的密钥, ecdh 模式下把设备的公钥放到 ready 消息里.
+// 返回的密钥在会话创建后用 storeSealKey 保存, 没有开启 ecdh 时为 nil
+func negotiateSeal(msg signal.Message, ready *signal.Message) (*signal.Key, error) {
+	if *sealMode != sealECDH {
+		return nil, nil
+	}
+	if msg.Key == "" {
+		return nil, errMissingPublicKey
+	}
+	keyPair, err := signal.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyPair.SharedKey(msg.Key, false)
+	if err != nil {
+		return nil, err
+	}
+	ready.Key = keyPair.PublicKey()
+	return key, nil
+}
+
+// storeSealKey 保存新建会话协商的密钥
+func storeSealKey(clientID string, key *signal.Key) {
+	if key == nil {
+		return
+	}
+	sealKeysLock.Lock()
+	sealKeys[clientID] = key
+	sealKeysLock.Unlock()
+}
+
+// sealKey 返回客户端的密钥, 没有开启加密时返回 nil
+func sealKey(clientID string) (*signal.Key, error) {
+	switch *sealMode {
+	case sealPSK:
+		return sharedSealKey, nil
+	case sealECDH:
+		sealKeysLock.Lock()
+		key := sealKeys[clientID]
+		sealKeysLock.Unlock()
+		if key == nil {
+			return nil, errNoSealKey
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// dropSealKey 连接关闭后删除客户端的密钥
+func dropSealKey(clientID string) {
+	sealKeysLock.Lock()
+	delete(sealKeys, clientID)
+	sealKeysLock.Unlock()
+}
+
+// openCandidate 解密 candidate, 没有开启加密时原样返回
+func openCandidate(key *signal.Key, msg signal.Message) (string, error) {
+	if key == nil {
+		return msg.Candidate, nil
+	}
+	candidate, err := key.Open(msg.Candidate, msg.AAD("candidate"))
+	return string(candidate), err
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"clientgo/logging"
+	"clientgo/signal"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// session 客户端通过 askToConnect 建立的会话
+//
+// pion/webrtc v2.1.2 的 SetRemoteDescription 只能调用一次 (pion/webrtc#207), 重新协商时
+// 按新的 track 创建一个新的 pc 交换 offer/answer, 新的 pc 连接后替换并关闭旧的 pc.
+// 会话的 token、密钥和正在播放的文件不变, 客户端也需要用新的 RTCPeerConnection 回复
+type session struct {
+	id      string
+	req     *signal.ConnectRequest
+	started time.Time
+	log     *logging.Logger
+	// channel 会话通过 channel 信令服务 (socket.io 或原生 WebSocket) 建立, 设备可以主动给客户端发送消息.
+	// REST 建立的会话只能等客户端请求
+	channel bool
+
+	mu        sync.Mutex
+	tracks    []signal.Track
+	nextTrack int
+	// files 播放中的文件, key 为 track ID
+	files map[string]*fileSource
+	// pending 重新协商中的 pc 和它的 track, 连接后替换 peers 中的 pc.
+	// 重新协商时 peers 中会话的占用按 pendingTracks 计算, committed 为当前 track 的占用, 放弃重新协商时恢复
+	pending       *webrtc.PeerConnection
+	pendingTracks []signal.Track
+	committed     usage
+	// restartTimer 等待发起 ICE 重启, restartDeadline 重启超时后关闭会话, 见 restart.go
+	restartTimer    *time.Timer
+	restartDeadline *time.Timer
+	closed          bool
+}
+
+// newSession 按建立连接的请求创建会话的初始 track
+func newSession(id string, req *signal.ConnectRequest) *session {
+	s := &session{
+		id:      id,
+		req:     req,
+		started: time.Now(),
+		log:     clientLogger(id, req.Action),
+		files:   make(map[string]*fileSource),
+	}
+	switch req.Action {
+	case signal.ActionPushToFileAndStream:
+		s.tracks = []signal.Track{s.newTrack(signal.Track{Kind: signal.KindAudio}), s.newTrack(signal.Track{Kind: signal.KindVideo})}
+	case signal.ActionPushToRTMP:
+		s.tracks = []signal.Track{
+			s.newTrack(signal.Track{Kind: signal.KindAudio}),
+			s.newTrack(signal.Track{Kind: signal.KindVideo}),
+			s.newTrack(signal.Track{Kind: signal.KindVideo}),
+		}
+	case signal.ActionPullFromStream:
+		s.tracks = []signal.Track{s.newTrack(signal.Track{Kind: signal.KindVideo, Stream: streamName(req.Stream), Quality: req.Quality})}
+	case signal.ActionPullFromFile:
+		file := req.File
+		if file == "" {
+			file = "test"
+		}
+		s.tracks = []signal.Track{s.newTrack(signal.Track{Kind: signal.KindVideo, File: file})}
+	}
+	return s
+}
+
+// streamName 会话推拉的直播流, 播放文件时为空
+func (s *session) streamName() string {
+	if s.req.Action == signal.ActionPullFromFile {
+		return ""
+	}
+	return streamName(s.req.Stream)
+}
+
+// newTrack 给 track 分配会话中唯一的 ID
+func (s *session) newTrack(t signal.Track) signal.Track {
+	s.nextTrack++
+	t.ID = fmt.Sprintf("%s%d", t.Kind, s.nextTrack)
+	return t
+}
+
+// newPeerConnection 按 tracks 创建 pc, 推流会话接收 tracks, 拉流会话发送 tracks
+func (s *session) newPeerConnection(tracks []signal.Track) (*webrtc.PeerConnection, error) {
+	peerConnection, err := sessionAPI(s.req).NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	watchPeerConnection(peerConnection, s.id, s.req.Action, s.streamName(), s.started)
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		logICEState(s.log, connectionState)
+		s.onICEStateChange(peerConnection, connectionState)
+	})
+	if err = s.addTracks(peerConnection, tracks); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+	return peerConnection, nil
+}
+
+func (s *session) addTracks(peerConnection *webrtc.PeerConnection, tracks []signal.Track) error {
+	switch s.req.Action {
+	case signal.ActionPushToFileAndStream:
+		if err := receiveTracks(peerConnection, trackKinds(tracks)...); err != nil {
+			return err
+		}
+		saveAndPublishTracks(peerConnection, s.id, streamName(s.req.Stream), s.req.Recording())
+	case signal.ActionPushToRTMP:
+		if err := receiveTracks(peerConnection, trackKinds(tracks)...); err != nil {
+			return err
+		}
+		pushTracksToPipeline(peerConnection, s.id)
+	default:
+		for _, t := range tracks {
+			if t.Stream != "" {
+				s.log.Info("拉直播流", "stream", t.Stream)
+				if err := pullFromStream(peerConnection, t.Stream, t.Quality, s.req.Bandwidth); err != nil {
+					return err
+				}
+				continue
+			}
+			s.log.Info("播放文件", "file", t.File)
+			source, err := s.file(t)
+			if err != nil {
+				return err
+			}
+			sender, err := peerConnection.AddTrack(source.track)
+			if err != nil {
+				return err
+			}
+			addTrackStats(peerConnection, source.report.stats)
+			go sendReports(peerConnection, source.report)
+			go readReceiverReports(sender, source.report)
+		}
+	}
+	return nil
+}
+
+// trackKinds 推流会话接收的 transceiver 类型
+func trackKinds(tracks []signal.Track) []webrtc.RTPCodecType {
+	kinds := make([]webrtc.RTPCodecType, 0, len(tracks))
+	for _, t := range tracks {
+		if t.Kind == signal.KindAudio {
+			kinds = append(kinds, webrtc.RTPCodecTypeAudio)
+		} else {
+			kinds = append(kinds, webrtc.RTPCodecTypeVideo)
+		}
+	}
+	return kinds
+}
+
+// file 返回 track 播放的文件, 第一次使用时打开文件开始播放
+func (s *session) file(t signal.Track) (*fileSource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if source := s.files[t.ID]; source != nil {
+		return source, nil
+	}
+	source, err := openFile(t.File)
+	if err != nil {
+		return nil, err
+	}
+	s.files[t.ID] = source
+	go playVideo(source)
+	return source, nil
+}
+
+// stopUnusedFiles 停止当前和重新协商中的 pc 都没有使用的文件播放
+func (s *session) stopUnusedFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, source := range s.files {
+		if !hasTrack(s.tracks, id) && !hasTrack(s.pendingTracks, id) {
+			source.stop()
+			delete(s.files, id)
+		}
+	}
+}
+
+func hasTrack(tracks []signal.Track, id string) bool {
+	for _, t := range tracks {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// renegotiate 设备发起的重新协商, 按 r 修改 track 后创建新的 pc, 返回设备的 offer 和新的 track
+func (s *session) renegotiate(r *signal.Renegotiation) (webrtc.SessionDescription, []signal.Track, error) {
+	s.mu.Lock()
+	tracks, err := s.applyLocked(r)
+	s.mu.Unlock()
+	if err != nil {
+		return webrtc.SessionDescription{}, nil, err
+	}
+	// 添加的直播流和文件也受资源上限限制
+	old, err := peers.updateUsage(s.id, usageOf(s.req.Action, tracks))
+	if err != nil {
+		return webrtc.SessionDescription{}, nil, err
+	}
+	if r.ICERestart {
+		s.log.Info("ICE 重启")
+	}
+	peerConnection, err := s.newPeerConnection(tracks)
+	if err != nil {
+		peers.restoreUsage(s.id, old)
+		s.stopUnusedFiles()
+		return webrtc.SessionDescription{}, nil, err
+	}
+	offer, err := peerConnection.CreateOffer(nil)
+	if err == nil {
+		err = peerConnection.SetLocalDescription(offer)
+	}
+	if err != nil {
+		peerConnection.Close()
+		peers.restoreUsage(s.id, old)
+		s.stopUnusedFiles()
+		return webrtc.SessionDescription{}, nil, err
+	}
+	s.setPending(peerConnection, tracks, old)
+	return offer, tracks, nil
+}
+
+// applyLocked 返回按 r 修改后的 track, 不修改会话
+func (s *session) applyLocked(r *signal.Renegotiation) ([]signal.Track, error) {
+	tracks := []signal.Track{}
+	if !r.Replace {
+		for _, id := range r.Remove {
+			if !hasTrack(s.tracks, id) {
+				return nil, signal.NewError(signal.CodeInvalidParams, "unknown track "+id)
+			}
+		}
+		for _, t := range s.tracks {
+			if !containsString(r.Remove, t.ID) {
+				tracks = append(tracks, t)
+			}
+		}
+	}
+	for _, t := range r.Add {
+		tracks = append(tracks, s.newTrack(t))
+	}
+	if len(tracks) == 0 {
+		return nil, signal.NewError(signal.CodeInvalidParams, "a session needs at least one track")
+	}
+	return tracks, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptOffer 客户端在已经协商过的会话上发送新的 offer, 创建新的 pc 回复 answer
+//
+// 推流会话按 offer 中发送的媒体接收 track, 拉流会话发送当前的 track
+func (s *session) acceptOffer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	tracks := s.currentTracks()
+	if s.req.Action.IsPush() {
+		s.mu.Lock()
+		tracks = s.matchKindsLocked(offerKinds(offer.SDP))
+		s.mu.Unlock()
+	}
+	old, err := peers.updateUsage(s.id, usageOf(s.req.Action, tracks))
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	peerConnection, err := s.newPeerConnection(tracks)
+	if err != nil {
+		peers.restoreUsage(s.id, old)
+		s.stopUnusedFiles()
+		return webrtc.SessionDescription{}, err
+	}
+	answer, err := answerOffer(peerConnection, offer)
+	if err != nil {
+		peerConnection.Close()
+		peers.restoreUsage(s.id, old)
+		s.stopUnusedFiles()
+		return webrtc.SessionDescription{}, err
+	}
+	s.setPending(peerConnection, tracks, old)
+	return answer, nil
+}
+
+// matchKindsLocked 按 kinds 的顺序复用同类型的 track, 不够时添加新的 track
+func (s *session) matchKindsLocked(kinds []string) []signal.Track {
+	used := make(map[string]bool)
+	tracks := make([]signal.Track, 0, len(kinds))
+	for _, kind := range kinds {
+		match := signal.Track{}
+		for _, t := range s.tracks {
+			if t.Kind == kind && !used[t.ID] {
+				match = t
+				break
+			}
+		}
+		if match.ID == "" {
+			match = s.newTrack(signal.Track{Kind: kind})
+		}
+		used[match.ID] = true
+		tracks = append(tracks, match)
+	}
+	return tracks
+}
+
+// offerKinds 返回 offer 中客户端发送的媒体类型
+func offerKinds(sdp string) []string {
+	kinds := []string{}
+	kind := ""
+	sending := false
+	flush := func() {
+		if kind != "" && sending {
+			kinds = append(kinds, kind)
+		}
+	}
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			flush()
+			kind, sending = "", true
+			if fields := strings.Fields(line[2:]); len(fields) > 0 &&
+				(fields[0] == signal.KindAudio || fields[0] == signal.KindVideo) {
+				kind = fields[0]
+			}
+		case line == "a=recvonly" || line == "a=inactive":
+			sending = false
+		}
+	}
+	flush()
+	return kinds
+}
+
+// currentTracks 当前 pc 的 track
+func (s *session) currentTracks() []signal.Track {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tracks
+}
+
+// pendingPeerConnection 重新协商中的 pc, 客户端的 answer 和 candidate 发给它
+func (s *session) pendingPeerConnection() *webrtc.PeerConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// setPending 开始重新协商, 之前没有完成的重新协商被放弃. committed 为 updateUsage 之前的占用,
+// 替换没有完成的重新协商时它只是那次重新协商的占用, 保留当前 track 的占用
+func (s *session) setPending(peerConnection *webrtc.PeerConnection, tracks []signal.Track, committed usage) {
+	s.mu.Lock()
+	old := s.pending
+	if old == nil {
+		s.committed = committed
+	}
+	s.pending, s.pendingTracks = peerConnection, tracks
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+		s.stopUnusedFiles()
+	}
+}
+
+// promote 重新协商的 pc 连接后替换会话当前的 pc, 重新协商的占用成为会话的占用
+func (s *session) promote(peerConnection *webrtc.PeerConnection) {
+	s.mu.Lock()
+	if s.pending != peerConnection {
+		s.mu.Unlock()
+		return
+	}
+	s.pending = nil
+	s.tracks, s.pendingTracks = s.pendingTracks, nil
+	s.mu.Unlock()
+
+	old, ok := peers.replace(s, peerConnection)
+	if !ok {
+		// 会话已经关闭
+		peerConnection.Close()
+		return
+	}
+
+	s.stopUnusedFiles()
+	if old != nil && old != peerConnection {
+		old.Close()
+	}
+	s.log.Info("重新协商完成")
+}
+
+// dropPending 放弃连接失败的重新协商, 恢复当前 track 的占用, 返回 peerConnection 是否是重新协商中的 pc
+func (s *session) dropPending(peerConnection *webrtc.PeerConnection) bool {
+	s.mu.Lock()
+	if s.pending != peerConnection {
+		s.mu.Unlock()
+		return false
+	}
+	s.pending, s.pendingTracks = nil, nil
+	peers.restoreUsage(s.id, s.committed)
+	s.mu.Unlock()
+	peerConnection.Close()
+	s.stopUnusedFiles()
+	return true
+}
+
+// close 关闭重新协商中的 pc, 停止播放文件和 ICE 重启, 当前的 pc 由 closePeerConnection 关闭
+func (s *session) close() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending, s.pendingTracks = nil, nil
+	s.closed = true
+	s.stopRestartLocked()
+	for id, source := range s.files {
+		source.stop()
+		delete(s.files, id)
+	}
+	s.mu.Unlock()
+	if pending != nil {
+		pending.Close()
+	}
+}
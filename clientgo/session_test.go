@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"clientgo/signal"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// startPending 像 renegotiate 一样按 u 占用资源后开始重新协商
+func startPending(t *testing.T, sess *session, u usage) *webrtc.PeerConnection {
+	old, err := peers.updateUsage(sess.id, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.setPending(pc, sess.currentTracks(), old)
+	return pc
+}
+
+// 放弃或者替换没有连接的重新协商后恢复会话当前的占用, 连接后才保留新的占用
+func TestRenegotiationUsage(t *testing.T) {
+	defer setLimit(maxFilePlaybacks, 2)()
+
+	req := &signal.ConnectRequest{Action: signal.ActionPullFromStream}
+	sess := newSession("viewer", req)
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peers.getOrCreate("viewer", usageOf(req.Action, sess.tracks), func() (*webrtc.PeerConnection, *session, error) {
+		return pc, sess, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer closePeerConnection("viewer")
+
+	otherCanPlay := func(files int) bool {
+		return peers.check("other", usage{files: files}) == nil
+	}
+
+	// 连接失败的重新协商
+	pending := startPending(t, sess, usage{files: 2})
+	if otherCanPlay(1) {
+		t.Fatalf("pending renegotiation does not reserve its files")
+	}
+	if !sess.dropPending(pending) {
+		t.Fatal("dropPending did not drop the pending pc")
+	}
+	if !otherCanPlay(2) {
+		t.Errorf("dropped renegotiation keeps its files")
+	}
+
+	// 没有完成的重新协商被新的重新协商替换, 新的也失败
+	startPending(t, sess, usage{files: 2})
+	pending = startPending(t, sess, usage{files: 1})
+	if otherCanPlay(2) || !otherCanPlay(1) {
+		t.Errorf("replaced renegotiation keeps its files")
+	}
+	sess.dropPending(pending)
+	if !otherCanPlay(2) {
+		t.Errorf("usage not restored after the replacing renegotiation failed")
+	}
+
+	// 连接成功的重新协商
+	pending = startPending(t, sess, usage{files: 1})
+	sess.promote(pending)
+	if otherCanPlay(2) || !otherCanPlay(1) {
+		t.Errorf("promoted renegotiation does not keep its files")
+	}
+}
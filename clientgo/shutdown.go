@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	ossignal "os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// 关闭设备时等待保存文件和停止管道的时间, 超时后直接退出
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for sessions to close and recordings to be finalized on SIGINT or SIGTERM")
+
+	// mediaTasks 处理推流的 goroutine, 关闭设备时等待它们保存文件和停止管道
+	mediaTasks sync.WaitGroup
+	// shuttingDown 设备正在关闭, 不再接受新的会话, 由 shutdownLock 保护
+	shuttingDown bool
+	shutdownLock sync.Mutex
+
+	errShuttingDown = errors.New("device is shutting down")
+)
+
+// isShuttingDown 设备是否正在关闭
+func isShuttingDown() bool {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	return shuttingDown
+}
+
+// beginMediaTask 开始处理一个推流的 track, 结束时调用 mediaTasks.Done.
+// 设备正在关闭时返回 false, 不再处理
+func beginMediaTask() bool {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	if shuttingDown {
+		return false
+	}
+	mediaTasks.Add(1)
+	return true
+}
+
+// waitForShutdown 等待 SIGINT 或 SIGTERM, 然后关闭设备并退出
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	ossignal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("收到退出信号, 开始关闭", "signal", sig, "timeout", *shutdownTimeout)
+	go func() {
+		// 再次收到信号时直接退出
+		<-signals
+		logger.Warn("再次收到退出信号, 直接退出")
+		os.Exit(1)
+	}()
+
+	if err := shutdown(*shutdownTimeout); err != nil {
+		logger.Error("关闭超时, 部分文件可能没有保存完成", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("已关闭")
+	os.Exit(0)
+}
+
+// shutdown 不再接受新的会话, 通知客户端并关闭所有连接, 等待推流的文件保存完成和管道停止
+func shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownLock.Lock()
+	shuttingDown = true
+	shutdownLock.Unlock()
+
+	// 停止 HTTP 服务, 正在处理的请求最多等待到超时
+	if restServer != nil {
+		if err := restServer.Shutdown(ctx); err != nil {
+			logger.Warn("关闭 REST 信令服务出错", "error", err)
+		}
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logger.Warn("关闭 WHIP/WHEP 服务出错", "error", err)
+		}
+	}
+
+	// 之后创建的会话被 peers 拒绝
+	for _, id := range peers.ids() {
+		hangUp(id, errShuttingDown.Error())
+	}
+
+	// 连接关闭后推流的读取结束, 保存文件并停止管道
+	done := make(chan struct{})
+	go func() {
+		mediaTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// 没有结束的推流直接关闭文件
+		recordingsLock.Lock()
+		rest := make([]*recorder, 0, len(recordings))
+		for _, r := range recordings {
+			rest = append(rest, r)
+		}
+		recordingsLock.Unlock()
+		for _, r := range rest {
+			r.Close()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,168 @@
+package signal
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Action 客户端请求设备做的事情
+type Action string
+
+// 设备支持的动作
+const (
+	// ActionPushToFileAndStream 推流, 保存为文件并作为直播流分发
+	ActionPushToFileAndStream Action = "push to file and stream"
+	// ActionPushToRTMP 推流到 gstreamer
+	ActionPushToRTMP Action = "push to rtmp"
+	// ActionPullFromStream 拉直播流
+	ActionPullFromStream Action = "pull from stream"
+	// ActionPullFromFile 播放保存的视频文件
+	ActionPullFromFile Action = "pull from file"
+)
+
+// Valid 是否是设备支持的动作
+func (a Action) Valid() bool {
+	switch a {
+	case ActionPushToFileAndStream, ActionPushToRTMP, ActionPullFromStream, ActionPullFromFile:
+		return true
+	}
+	return false
+}
+
+// IsPush 是否是推流的动作
+func (a Action) IsPush() bool {
+	return a == ActionPushToFileAndStream || a == ActionPushToRTMP
+}
+
+// Codecs 设备支持的编码, 和 pion/webrtc 的编码名称相同
+var Codecs = []string{"VP8", "VP9", "H264", "opus", "G722"}
+
+// namePattern 流名称和文件 ID 的格式, 不能包含路径分隔符
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_.\-]{0,63}$`)
+
+// ConnectRequest askToConnect 的参数, 放在 Message.Msg 中
+//
+// 新客户端发送 JSON:
+//
+//	{"action": "pull from stream", "stream": "camera1"}
+//
+// 旧客户端的 Msg 只有动作名称, 其他参数使用默认值
+//
+//	Action  动作
+//	Stream  推流或拉流的直播流名称, 为空时是设备的直播流
+//	File    播放的文件 ID, 对应 ID.ivf, 为空时播放 test.ivf
+//	Codecs  协商使用的编码, 为空时使用设备支持的所有编码
+//	Record  推流时是否保存文件, 默认保存
+//	DeviceOffer  拉流时由设备生成 offer, 放在 ready 消息的 Sdp 中, 客户端回复 answer
+//	Quality  拉直播流时请求的 simulcast 画质, low、mid 或 high, 为空时使用最高的一层
+//	Bandwidth  拉直播流时的带宽, kbps, 大于 0 时选择码率不超过带宽的 simulcast 层
+type ConnectRequest struct {
+	Action      Action   `json:"action"`
+	Stream      string   `json:"stream,omitempty"`
+	File        string   `json:"file,omitempty"`
+	Codecs      []string `json:"codecs,omitempty"`
+	Record      *bool    `json:"record,omitempty"`
+	DeviceOffer bool     `json:"deviceOffer,omitempty"`
+	Quality     string   `json:"quality,omitempty"`
+	Bandwidth   int      `json:"bandwidth,omitempty"`
+}
+
+// ParseConnectRequest 解析并校验 askToConnect 的 Msg
+func ParseConnectRequest(msg string) (*ConnectRequest, error) {
+	req := &ConnectRequest{}
+	if strings.HasPrefix(strings.TrimSpace(msg), "{") {
+		if err := json.Unmarshal([]byte(msg), req); err != nil {
+			return nil, NewError(CodeInvalidParams, "malformed request: "+err.Error())
+		}
+	} else {
+		req.Action = Action(msg)
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Validate 校验动作和参数, 参数只能用于对应的动作
+func (r *ConnectRequest) Validate() error {
+	if !r.Action.Valid() {
+		return NewError(CodeInvalidAction, "unknown action "+strings.TrimSpace(string(r.Action)))
+	}
+	if r.Stream != "" {
+		if r.Action != ActionPushToFileAndStream && r.Action != ActionPullFromStream {
+			return NewError(CodeInvalidParams, "stream is not allowed for "+string(r.Action))
+		}
+		if !namePattern.MatchString(r.Stream) {
+			return NewError(CodeInvalidParams, "invalid stream name "+r.Stream)
+		}
+	}
+	if r.File != "" {
+		if r.Action != ActionPullFromFile {
+			return NewError(CodeInvalidParams, "file is not allowed for "+string(r.Action))
+		}
+		if !namePattern.MatchString(r.File) || strings.Contains(r.File, "..") {
+			return NewError(CodeInvalidParams, "invalid file id "+r.File)
+		}
+	}
+	if r.Record != nil && r.Action != ActionPushToFileAndStream {
+		return NewError(CodeInvalidParams, "record is not allowed for "+string(r.Action))
+	}
+	if r.DeviceOffer && r.Action.IsPush() {
+		// 推流会话需要客户端的 offer 才知道接收哪些媒体
+		return NewError(CodeInvalidParams, "deviceOffer is only allowed for pull actions")
+	}
+	if (r.Quality != "" || r.Bandwidth != 0) && r.Action != ActionPullFromStream {
+		return NewError(CodeInvalidParams, "quality and bandwidth are only allowed for "+string(ActionPullFromStream))
+	}
+	if r.Quality != "" && !validQuality(r.Quality) {
+		return NewError(CodeInvalidParams, "invalid quality "+r.Quality)
+	}
+	if r.Bandwidth < 0 {
+		return NewError(CodeInvalidParams, "bandwidth must not be negative")
+	}
+	for i, codec := range r.Codecs {
+		name, ok := codecName(codec)
+		if !ok {
+			return NewError(CodeInvalidParams, "unsupported codec "+codec)
+		}
+		r.Codecs[i] = name
+	}
+	if r.Action == ActionPullFromFile && len(r.Codecs) > 0 && !r.HasCodec("VP8") {
+		return NewError(CodeInvalidParams, "files are VP8, codecs must include VP8")
+	}
+	return nil
+}
+
+// HasCodec 是否协商 codec, 没有指定编码时为所有编码
+func (r *ConnectRequest) HasCodec(codec string) bool {
+	if len(r.Codecs) == 0 {
+		return true
+	}
+	for _, c := range r.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// Recording 推流时是否保存文件
+func (r *ConnectRequest) Recording() bool {
+	return r.Record == nil || *r.Record
+}
+
+// validQuality 是否是 simulcast 的画质, 和 clientgo/simulcast 的层相同
+func validQuality(quality string) bool {
+	return quality == "low" || quality == "mid" || quality == "high"
+}
+
+// codecName 返回 pion/webrtc 的编码名称, 不区分大小写
+func codecName(codec string) (string, bool) {
+	for _, name := range Codecs {
+		if strings.EqualFold(name, codec) {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,91 @@
+package signal
+
+// Code 错误消息的错误码, 在 Message.Code 中回复给客户端, 客户端根据错误码处理,
+// Msg 只是给人看的说明, 内容可能变化
+type Code string
+
+// 错误码和对应的错误
+//
+//	invalid_action     askToConnect 的动作不支持
+//	invalid_params     动作的参数不合法, 或消息格式错误
+//	unauthorized       token 无效或过期, 需要重新获取 token
+//	forbidden          token 不是这个设备的, 或没有动作需要的权限
+//	device_offline     设备不在线, 由信令服务回复; 设备正在关闭时由设备回复
+//	session_not_found  没有 askToConnect 就发送了 offer, 或连接已关闭
+//	session_exists     客户端已经有会话时再次 askToConnect, 需要先关闭之前的会话
+//	bad_sdp            offer 无法解析, 或设备无法根据 offer 生成 answer
+//	bad_candidate      candidate 无法解析或添加
+//	seal_failed        加密的 sdp 或 candidate 无法解密, 或缺少加密的密钥
+//	stream_not_found   拉取的直播流没有推流
+//	file_not_found     播放的文件不存在
+//	unsupported        请求的功能设备不支持, 例如 rid 方式的 simulcast
+//	limit_exceeded     设备的连接、推流端、直播流的拉流端或文件播放数量达到上限
+//	timeout            设备没有及时处理请求
+//	internal           设备内部错误, 例如创建连接失败
+const (
+	CodeInvalidAction   Code = "invalid_action"
+	CodeInvalidParams   Code = "invalid_params"
+	CodeUnauthorized    Code = "unauthorized"
+	CodeForbidden       Code = "forbidden"
+	CodeDeviceOffline   Code = "device_offline"
+	CodeSessionNotFound Code = "session_not_found"
+	CodeSessionExists   Code = "session_exists"
+	CodeBadSDP          Code = "bad_sdp"
+	CodeBadCandidate    Code = "bad_candidate"
+	CodeSealFailed      Code = "seal_failed"
+	CodeStreamNotFound  Code = "stream_not_found"
+	CodeFileNotFound    Code = "file_not_found"
+	CodeUnsupported     Code = "unsupported"
+	CodeLimitExceeded   Code = "limit_exceeded"
+	CodeTimeout         Code = "timeout"
+	CodeInternal        Code = "internal"
+)
+
+// Error 带错误码的错误
+type Error struct {
+	Code Code
+	Msg  string
+}
+
+// NewError 创建带错误码的错误
+func NewError(code Code, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// WithCode 给 err 加上错误码, 已经有错误码的错误不变
+func WithCode(code Code, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	if c := CodeOf(err); c != "" {
+		code = c
+	}
+	return &Error{Code: code, Msg: err.Error()}
+}
+
+// CodeOf 返回 signal 包错误的错误码, 其他错误返回 ""
+func CodeOf(err error) Code {
+	switch err {
+	case ErrSealed, ErrNotSealed, ErrTampered:
+		return CodeSealFailed
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Msg
+}
+
+// ErrorMessage 由 from 回复给 to 的错误消息
+func ErrorMessage(from, to string, err *Error) Message {
+	return Message{
+		Type: "error",
+		From: from,
+		To:   to,
+		Msg:  err.Msg,
+		Code: err.Code,
+	}
+}
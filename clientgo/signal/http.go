@@ -1,31 +1,173 @@
 package signal
 
 import (
-	"flag"
-	"fmt"
-	"io/ioutil"
+	"context"
+	"encoding/json"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 )
 
-// HTTPSDPServer starts a HTTP Server that consumes SDPs
-func HTTPSDPServer() chan string {
-	port := flag.Int("port", 8080, "http server port")
-	flag.Parse()
+const (
+	// DefaultHTTPAddr is used when HTTPOptions.Addr is empty
+	DefaultHTTPAddr = ":8080"
 
-	sdpChan := make(chan string)
-	http.HandleFunc("/sdp", func(w http.ResponseWriter, r *http.Request) {
-		body, _ := ioutil.ReadAll(r.Body)
-		fmt.Fprintf(w, "done")
-		sdpChan <- string(body)
+	// DefaultHTTPTimeout is used when HTTPOptions.Timeout is zero
+	DefaultHTTPTimeout = 10 * time.Second
+
+	// maxMessageSize bounds the JSON body of a request
+	maxMessageSize = 1 << 20
+)
+
+// HTTPOptions configures an HTTPServer
+type HTTPOptions struct {
+	// Addr is the TCP address to listen on
+	Addr string
+
+	// CertFile and KeyFile enable TLS when both are set
+	CertFile string
+	KeyFile  string
+
+	// PathPrefix is prepended to every route, e.g. "/signal"
+	PathPrefix string
+
+	// Timeout bounds the time spent answering a single request
+	Timeout time.Duration
+}
+
+// Handler answers the messages a browser posts to an HTTPServer. Both
+// methods mirror the socket.io events of the channel service.
+type Handler interface {
+	// Connect handles a request to connect, the askToConnect event, and
+	// returns the ready or error message for the browser.
+	Connect(ctx context.Context, msg Message) (Message, error)
+
+	// Message handles an offer or a candidate, the messageToDevice event.
+	// A nil reply is answered with 204 No Content.
+	Message(ctx context.Context, msg Message) (*Message, error)
+}
+
+// HTTPServer exchanges signaling Messages as JSON over HTTP
+//
+//	POST {prefix}/connect  body Message, response Message
+//	POST {prefix}/message  body Message, response Message or 204
+//
+// Every request is answered in its own response, so a browser polling
+// the server never receives the answer meant for another one.
+type HTTPServer struct {
+	options HTTPOptions
+	handler Handler
+	server  *http.Server
+}
+
+// NewHTTPServer builds an HTTPServer, call ListenAndServe to start it
+func NewHTTPServer(options HTTPOptions, handler Handler) *HTTPServer {
+	if options.Addr == "" {
+		options.Addr = DefaultHTTPAddr
+	}
+	if options.Timeout == 0 {
+		options.Timeout = DefaultHTTPTimeout
+	}
+	options.PathPrefix = strings.TrimSuffix(options.PathPrefix, "/")
+
+	s := &HTTPServer{
+		options: options,
+		handler: handler,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(options.PathPrefix+"/connect", s.serveConnect)
+	mux.HandleFunc(options.PathPrefix+"/message", s.serveMessage)
+	s.server = &http.Server{
+		Addr:         options.Addr,
+		Handler:      mux,
+		ReadTimeout:  options.Timeout,
+		WriteTimeout: options.Timeout + time.Second,
+	}
+	return s
+}
+
+// ListenAndServe serves until Shutdown is called, it uses TLS when
+// CertFile and KeyFile are set. It returns nil after a Shutdown.
+func (s *HTTPServer) ListenAndServe() error {
+	var err error
+	if s.options.CertFile != "" && s.options.KeyFile != "" {
+		err = s.server.ListenAndServeTLS(s.options.CertFile, s.options.KeyFile)
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and waits for the pending ones
+// until ctx is done
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *HTTPServer) serveConnect(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, func(ctx context.Context, msg Message) (*Message, error) {
+		reply, err := s.handler.Connect(ctx, msg)
+		return &reply, err
 	})
+}
+
+func (s *HTTPServer) serveMessage(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, s.handler.Message)
+}
+
+type handlerResult struct {
+	reply *Message
+	err   error
+}
 
+// serve decodes the posted Message, runs handle with the request timeout
+// and writes its reply
+func (s *HTTPServer) serve(w http.ResponseWriter, r *http.Request, handle func(context.Context, Message) (*Message, error)) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, NewError(CodeInvalidParams, http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	var msg Message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&msg); err != nil {
+		writeJSONError(w, http.StatusBadRequest, WithCode(CodeInvalidParams, err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.options.Timeout)
+	defer cancel()
+
+	// The result channel is buffered so a handler finishing after the
+	// timeout never blocks
+	result := make(chan handlerResult, 1)
 	go func() {
-		err := http.ListenAndServe(":"+strconv.Itoa(*port), nil)
-		if err != nil {
-			panic(err)
-		}
+		reply, err := handle(ctx, msg)
+		result <- handlerResult{reply, err}
 	}()
 
-	return sdpChan
+	select {
+	case res := <-result:
+		switch {
+		case res.err != nil:
+			writeJSONError(w, http.StatusInternalServerError, WithCode(CodeInternal, res.err))
+		case res.reply == nil:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSON(w, http.StatusOK, res.reply)
+		}
+	case <-ctx.Done():
+		writeJSONError(w, http.StatusGatewayTimeout, WithCode(CodeTimeout, ctx.Err()))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, msg *Message) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(msg)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err *Error) {
+	writeJSON(w, status, &Message{Type: "error", Msg: err.Msg, Code: err.Code})
 }
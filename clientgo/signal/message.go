@@ -0,0 +1,30 @@
+package signal
+
+// Message 客户端发送和接收的信息格式
+//
+//	From 客户端的socket.ID
+//	To  server的Mac 地址
+//	Sdp  base64 编码的sdp, 开启加密时为 Key.Seal 的密文; ready 消息带 Sdp 时为设备的 offer
+//	Type  消息的类型
+//	Msg  当消息类型为错误的时候，附带的信息; askToConnect 时为动作或 ConnectRequest 的 JSON
+//	Candidate  candidate 验证参数, 开启加密时为 Key.Seal 的密文
+//	SDPMid  candidate 验证参数
+//	SDPMLineIndex  candidate 验证参数
+//	UsernameFragment  candidate 验证参数
+//	Token  访问令牌, canConnect 和 messageToDevice 需要携带, 见 auth 包
+//	Key  ECDH 加密模式下双方的公钥, 在 canConnect 和 ready 消息中交换, 见 KeyPair
+//	Code  错误消息的错误码, 见 Code
+type Message struct {
+	From             string `json:"from"`
+	To               string `json:"to"`
+	Sdp              string `json:"sdp"`
+	Type             string `json:"type"`
+	Msg              string `json:"msg"`
+	Candidate        string `json:"candidate"`
+	SDPMid           string `json:"sdpMid"`
+	SDPMLineIndex    uint16 `json:"sdpMLineIndex"`
+	UsernameFragment string `json:"usernameFragment"`
+	Token            string `json:"token,omitempty"`
+	Key              string `json:"key,omitempty"`
+	Code             Code   `json:"code,omitempty"`
+}
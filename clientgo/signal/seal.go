@@ -0,0 +1,151 @@
+package signal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealedPrefix marks a sealed envelope, base64 never contains a dot so
+// sealed and plain payloads can not be confused
+const sealedPrefix = "sealed.v1."
+
+// keyInfo is the HKDF info of every derived key
+const keyInfo = "webrtc-signal sealed payload v1"
+
+var (
+	// ErrSealed is returned when a sealed payload is decoded without a key
+	ErrSealed = errors.New("signal: payload is sealed")
+
+	// ErrNotSealed is returned when a key is set but the payload is plain,
+	// accepting it would let the relay downgrade the session
+	ErrNotSealed = errors.New("signal: payload is not sealed")
+
+	// ErrTampered is returned when a sealed payload fails authentication
+	ErrTampered = errors.New("signal: sealed payload was tampered with")
+)
+
+// Key seals and opens the Sdp and Candidate fields of a Message with
+// AES-256-GCM. The relay server only sees the envelope
+//
+//	sealed.v1.base64(nonce || ciphertext || tag)
+type Key struct {
+	aead cipher.AEAD
+}
+
+// NewKey derives a Key from a secret shared by browser and device
+func NewKey(secret []byte) (*Key, error) {
+	return deriveKey(secret, nil)
+}
+
+func deriveKey(secret, salt []byte) (*Key, error) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(keyInfo)), raw); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead}, nil
+}
+
+// Seal encrypts plaintext and authenticates it together with aad
+func (k *Key) Seal(plaintext, aad []byte) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, plaintext, aad)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts an envelope made by Seal with the same aad
+func (k *Key) Open(envelope string, aad []byte) ([]byte, error) {
+	if !IsSealed(envelope) {
+		return nil, ErrNotSealed
+	}
+	sealed, err := base64.StdEncoding.DecodeString(envelope[len(sealedPrefix):])
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return nil, ErrTampered
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether in is a sealed envelope
+func IsSealed(in string) bool {
+	return strings.HasPrefix(in, sealedPrefix)
+}
+
+// AAD returns the additional data sealing field of msg. It binds the
+// payload to the sender, the receiver and the message type, so the relay
+// can not replay it in another message.
+func (m *Message) AAD(field string) []byte {
+	return []byte(m.From + "\n" + m.To + "\n" + m.Type + "\n" + field)
+}
+
+// KeyPair is an ephemeral P-256 key used to agree on a Key with ECDH on
+// first contact. The public key is exchanged in Message.Key.
+type KeyPair struct {
+	private []byte
+	x, y    *big.Int
+}
+
+// GenerateKeyPair returns a new ephemeral KeyPair
+func GenerateKeyPair() (*KeyPair, error) {
+	private, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{private: private, x: x, y: y}, nil
+}
+
+// PublicKey returns the uncompressed public point, base64 encoded. It is
+// the "raw" format of WebCrypto.
+func (p *KeyPair) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), p.x, p.y))
+}
+
+// SharedKey derives the Key shared with the owner of peerPublic. The
+// HKDF salt is both public keys, initiator first, so both sides derive
+// the same Key.
+func (p *KeyPair) SharedKey(peerPublic string, initiator bool) (*Key, error) {
+	raw, err := base64.StdEncoding.DecodeString(peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("signal: invalid public key")
+	}
+	shared, _ := curve.ScalarMult(x, y, p.private)
+	secret := make([]byte, 32)
+	b := shared.Bytes()
+	copy(secret[len(secret)-len(b):], b)
+
+	own := elliptic.Marshal(curve, p.x, p.y)
+	salt := append(append([]byte{}, raw...), own...)
+	if initiator {
+		salt = append(append([]byte{}, own...), raw...)
+	}
+	return deriveKey(secret, salt)
+}
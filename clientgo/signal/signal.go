@@ -75,6 +75,41 @@ func Decode(in string, obj interface{}) {
 	}
 }
 
+// EncodeWith encodes obj like Encode and seals it with key, binding it to
+// aad. A nil key encodes plain base64 like Encode.
+func EncodeWith(key *Key, obj interface{}, aad []byte) (string, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return base64.StdEncoding.EncodeToString(b), nil
+	}
+	return key.Seal(b, aad)
+}
+
+// DecodeWith decodes in, made by EncodeWith with the same key and aad,
+// into obj. Sealed input is rejected without a key and plain input with
+// one, tampered input returns ErrTampered.
+func DecodeWith(key *Key, in string, aad []byte, obj interface{}) error {
+	var (
+		b   []byte
+		err error
+	)
+	switch {
+	case key != nil:
+		b, err = key.Open(in, aad)
+	case IsSealed(in):
+		err = ErrSealed
+	default:
+		b, err = base64.StdEncoding.DecodeString(in)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}
+
 func zip(in []byte) []byte {
 	var b bytes.Buffer
 	gz := gzip.NewWriter(&b)
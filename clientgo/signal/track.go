@@ -0,0 +1,100 @@
+package signal
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Track 会话中的一路媒体, 拉流会话发送直播流或文件, 推流会话接收推流
+//
+//	ID  设备分配的 ID, 在会话中唯一, 删除 track 时使用
+//	Kind  audio 或 video
+//	Stream  拉流会话发送的直播流名称
+//	File  拉流会话发送的文件 ID
+//	Quality  直播流使用 simulcast 时请求的画质, low、mid 或 high, 为空时使用最高的一层
+type Track struct {
+	ID      string `json:"id,omitempty"`
+	Kind    string `json:"kind"`
+	Stream  string `json:"stream,omitempty"`
+	File    string `json:"file,omitempty"`
+	Quality string `json:"quality,omitempty"`
+}
+
+// Track 的类型
+const (
+	KindAudio = "audio"
+	KindVideo = "video"
+)
+
+// Renegotiation renegotiate 消息的 Msg, 在已有的会话中添加和删除 track
+//
+//	Add  添加的 track, 推流会话只需要 Kind, 拉流会话需要 Stream 或 File
+//	Remove  删除的 track ID
+//	Replace  删除会话中已有的所有 track
+//	ICERestart  ICE 重启, 网络切换后不修改 track 重新建立连接
+//
+// 设备回复 offer 消息, Msg 为重新协商后会话的所有 Track, 客户端回复 answer.
+// 设备检测到连接断开时也会主动发送 ICE 重启的 offer
+type Renegotiation struct {
+	Add        []Track  `json:"add,omitempty"`
+	Remove     []string `json:"remove,omitempty"`
+	Replace    bool     `json:"replace,omitempty"`
+	ICERestart bool     `json:"iceRestart,omitempty"`
+}
+
+// ParseRenegotiation 解析 renegotiate 消息的 Msg, 并按会话的动作校验
+func ParseRenegotiation(msg string, action Action) (*Renegotiation, error) {
+	r := &Renegotiation{}
+	if err := json.Unmarshal([]byte(msg), r); err != nil {
+		return nil, NewError(CodeInvalidParams, "malformed renegotiation: "+err.Error())
+	}
+	if err := r.Validate(action); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Validate 推流会话只能添加接收的 track, 拉流会话只能添加直播流和文件
+func (r *Renegotiation) Validate(action Action) error {
+	if len(r.Add) == 0 && len(r.Remove) == 0 && !r.Replace && !r.ICERestart {
+		return NewError(CodeInvalidParams, "nothing to renegotiate")
+	}
+	if r.ICERestart && (len(r.Add) > 0 || len(r.Remove) > 0 || r.Replace) {
+		return NewError(CodeInvalidParams, "an ICE restart does not change tracks")
+	}
+	for i := range r.Add {
+		t := &r.Add[i]
+		t.ID = ""
+		if action.IsPush() {
+			if t.Stream != "" || t.File != "" || t.Quality != "" {
+				return NewError(CodeInvalidParams, "push sessions only receive tracks")
+			}
+			if t.Kind != KindAudio && t.Kind != KindVideo {
+				return NewError(CodeInvalidParams, "invalid track kind "+t.Kind)
+			}
+			continue
+		}
+		if t.Kind != "" && t.Kind != KindVideo {
+			return NewError(CodeInvalidParams, "only video tracks can be pulled")
+		}
+		t.Kind = KindVideo
+		switch {
+		case (t.Stream == "") == (t.File == ""):
+			return NewError(CodeInvalidParams, "a pulled track needs either a stream or a file")
+		case t.Stream != "" && !namePattern.MatchString(t.Stream):
+			return NewError(CodeInvalidParams, "invalid stream name "+t.Stream)
+		case t.File != "" && (!namePattern.MatchString(t.File) || strings.Contains(t.File, "..")):
+			return NewError(CodeInvalidParams, "invalid file id "+t.File)
+		case t.Quality != "" && t.Stream == "":
+			return NewError(CodeInvalidParams, "quality is only valid for streams")
+		case t.Quality != "" && !validQuality(t.Quality):
+			return NewError(CodeInvalidParams, "invalid quality "+t.Quality)
+		}
+	}
+	for _, id := range r.Remove {
+		if id == "" {
+			return NewError(CodeInvalidParams, "empty track id")
+		}
+	}
+	return nil
+}
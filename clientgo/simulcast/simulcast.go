@@ -0,0 +1,187 @@
+// Package simulcast finds the simulcast layers a publisher signals in its
+// offer, and rewrites the offer so pion/webrtc v2.1.2 receives every layer.
+//
+// Only SSRC signaled simulcast (a=ssrc-group:SIM) is supported, browsers
+// only send it when the offer is munged. The standard browser simulcast,
+// addTransceiver with sendEncodings, is RID based (a=rid and a=simulcast,
+// layers told apart by the rtp-stream-id header extension) and is not
+// supported: pion/webrtc v2.1.2 drops RTP with SSRCs missing from the offer
+// and can not negotiate RIDs in its answer. Receiving it needs pion/webrtc v3.
+package simulcast
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Qualities of the layers, lowest first
+const (
+	Low  = "low"
+	Mid  = "mid"
+	High = "high"
+)
+
+var (
+	// ErrRIDUnsupported is returned for offers using RID based simulcast,
+	// as browsers send for addTransceiver with sendEncodings
+	ErrRIDUnsupported = errors.New("simulcast: rid based simulcast (sendEncodings) is not supported, signal the layers with a=ssrc-group:SIM")
+
+	// ErrTooManyLayers is returned when a SIM group has more than 3 SSRCs
+	ErrTooManyLayers = errors.New("simulcast: at most 3 layers are supported")
+)
+
+// Layer is one encoding of a simulcast video
+type Layer struct {
+	SSRC    uint32
+	Quality string
+}
+
+// Qualities returns the qualities of n layers, lowest first. A video
+// without simulcast has a single High layer.
+func Qualities(n int) []string {
+	switch n {
+	case 1:
+		return []string{High}
+	case 2:
+		return []string{Low, High}
+	}
+	return []string{Low, Mid, High}
+}
+
+// Rank orders qualities, it returns -1 for unknown qualities
+func Rank(quality string) int {
+	switch quality {
+	case Low:
+		return 0
+	case Mid:
+		return 1
+	case High:
+		return 2
+	}
+	return -1
+}
+
+// Prepare returns the layers signaled in sdp, lowest first, and the sdp to
+// give to pion/webrtc. The layers are empty when the offer has no
+// simulcast, sdp is then returned unchanged.
+//
+// pion/webrtc only receives the first SSRC having a msid in a media
+// section, so the msid lines of the layers are removed. Retransmission
+// (FID) SSRCs are removed too, pion/webrtc would take them for layers.
+// Only the first simulcast video section is rewritten.
+func Prepare(sdp string) (string, []Layer, error) {
+	lines := strings.Split(sdp, "\n")
+	sections := splitSections(lines)
+	var layers []Layer
+	out := make([]string, 0, len(lines))
+	for _, section := range sections {
+		if layers != nil || !isVideo(section) {
+			out = append(out, section...)
+			continue
+		}
+		sim, rtx, hasRID := parseGroups(section)
+		if sim == nil {
+			if hasRID {
+				return "", nil, ErrRIDUnsupported
+			}
+			out = append(out, section...)
+			continue
+		}
+		if len(sim) > 3 {
+			return "", nil, ErrTooManyLayers
+		}
+		qualities := Qualities(len(sim))
+		layers = make([]Layer, len(sim))
+		for i, ssrc := range sim {
+			layers[i] = Layer{SSRC: ssrc, Quality: qualities[i]}
+		}
+		for _, line := range section {
+			if !dropLine(strings.TrimRight(line, "\r"), sim, rtx) {
+				out = append(out, line)
+			}
+		}
+	}
+	if layers == nil {
+		return sdp, nil, nil
+	}
+	return strings.Join(out, "\n"), layers, nil
+}
+
+// splitSections splits the lines of a sdp into the session section and
+// one section per m= line
+func splitSections(lines []string) [][]string {
+	sections := [][]string{}
+	start := 0
+	for i, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			sections = append(sections, lines[start:i])
+			start = i
+		}
+	}
+	return append(sections, lines[start:])
+}
+
+func isVideo(section []string) bool {
+	return len(section) > 0 && strings.HasPrefix(section[0], "m=video ")
+}
+
+// parseGroups returns the SSRCs of the SIM group, the retransmission SSRCs
+// of the FID groups, and whether the section uses RID simulcast
+func parseGroups(section []string) (sim []uint32, rtx map[uint32]bool, hasRID bool) {
+	rtx = make(map[uint32]bool)
+	for _, line := range section {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "a=ssrc-group:SIM "):
+			sim = parseSSRCs(strings.Fields(line)[1:])
+		case strings.HasPrefix(line, "a=ssrc-group:FID "):
+			if ssrcs := parseSSRCs(strings.Fields(line)[1:]); len(ssrcs) == 2 {
+				rtx[ssrcs[1]] = true
+			}
+		case strings.HasPrefix(line, "a=rid:"), strings.HasPrefix(line, "a=simulcast:"):
+			hasRID = true
+		}
+	}
+	return sim, rtx, hasRID
+}
+
+func parseSSRCs(fields []string) []uint32 {
+	ssrcs := make([]uint32, 0, len(fields))
+	for _, field := range fields {
+		ssrc, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil
+		}
+		ssrcs = append(ssrcs, uint32(ssrc))
+	}
+	return ssrcs
+}
+
+// dropLine reports whether line is a FID group, a line of a
+// retransmission SSRC or the msid of a layer
+func dropLine(line string, sim []uint32, rtx map[uint32]bool) bool {
+	if strings.HasPrefix(line, "a=ssrc-group:FID ") {
+		return true
+	}
+	if !strings.HasPrefix(line, "a=ssrc:") {
+		return false
+	}
+	fields := strings.Fields(line[len("a=ssrc:"):])
+	if len(fields) < 2 {
+		return false
+	}
+	ssrc, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return false
+	}
+	if rtx[uint32(ssrc)] {
+		return true
+	}
+	for _, s := range sim {
+		if s == uint32(ssrc) {
+			return strings.HasPrefix(fields[1], "msid:")
+		}
+	}
+	return false
+}
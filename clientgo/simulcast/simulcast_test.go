@@ -0,0 +1,44 @@
+package simulcast
+
+import (
+	"strings"
+	"testing"
+)
+
+const videoHeader = "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na=rtpmap:96 VP8/90000\r\n"
+
+// The offer of addTransceiver with sendEncodings has RIDs and no SSRCs
+func TestPrepareRejectsRIDSimulcast(t *testing.T) {
+	sdp := videoHeader +
+		"a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id\r\n" +
+		"a=rid:q send\r\na=rid:h send\r\na=rid:f send\r\n" +
+		"a=simulcast:send q;h;f\r\n"
+	if _, _, err := Prepare(sdp); err != ErrRIDUnsupported {
+		t.Errorf("Prepare returned %v, want ErrRIDUnsupported", err)
+	}
+}
+
+func TestPrepareSSRCSimulcast(t *testing.T) {
+	sdp := videoHeader +
+		"a=ssrc-group:FID 1 11\r\n" +
+		"a=ssrc-group:SIM 1 2 3\r\n" +
+		"a=ssrc:1 msid:s v\r\na=ssrc:11 msid:s v\r\n" +
+		"a=ssrc:2 msid:s v\r\na=ssrc:3 msid:s v\r\n"
+	out, layers, err := Prepare(sdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Layer{{1, Low}, {2, Mid}, {3, High}}
+	if len(layers) != len(want) {
+		t.Fatalf("layers %v, want %v", layers, want)
+	}
+	for i := range want {
+		if layers[i] != want[i] {
+			t.Errorf("layer %d is %v, want %v", i, layers[i], want[i])
+		}
+	}
+	if strings.Count(out, "msid:") != 0 || strings.Contains(out, "a=ssrc-group:FID") {
+		t.Errorf("msid or FID lines kept:\n%s", out)
+	}
+}
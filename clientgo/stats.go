@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"clientgo/signal"
+	"clientgo/stats"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+var (
+	// peerStats 每个连接的统计, key 为 pc, 连接关闭后在下一次读取统计时删除
+	peerStats     = make(map[*webrtc.PeerConnection]*connStats)
+	peerStatsLock sync.Mutex
+
+	// 定时给浏览器发送 stats 消息的间隔
+	statsInterval = flag.Duration("stats-interval", 5*time.Second, "interval of the stats messages pushed to browsers, disabled if 0")
+)
+
+// connStats 一个连接的会话信息和所有 track 的统计
+//
+// 重新协商创建的 pc 和会话使用相同的 clientID 和开始时间
+type connStats struct {
+	clientID string
+	action   signal.Action
+	stream   string
+	started  time.Time
+
+	mu     sync.Mutex
+	tracks []stats.Track
+}
+
+// sessionStats 一个会话的统计, 字节数为所有 track 的合计
+type sessionStats struct {
+	ClientID      string              `json:"clientId"`
+	Action        signal.Action       `json:"action"`
+	Stream        string              `json:"stream,omitempty"`
+	Started       time.Time           `json:"started"`
+	ICEState      string              `json:"iceState"`
+	CandidatePair *candidatePairStats `json:"candidatePair,omitempty"`
+	BytesReceived uint64              `json:"bytesReceived"`
+	BytesSent     uint64              `json:"bytesSent"`
+	Tracks        []stats.TrackStats  `json:"tracks"`
+}
+
+// candidatePairStats 连接正在使用的 ICE candidate pair
+type candidatePairStats struct {
+	Local  candidateStats `json:"local"`
+	Remote candidateStats `json:"remote"`
+}
+
+type candidateStats struct {
+	IP       string `json:"ip"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	Type     string `json:"type"`
+}
+
+// watchPeerConnection 开始统计连接, 之后添加的 track 由 addTrackStats 记录
+func watchPeerConnection(peerConnection *webrtc.PeerConnection, clientID string, action signal.Action, stream string, started time.Time) {
+	peerStatsLock.Lock()
+	defer peerStatsLock.Unlock()
+	peerStats[peerConnection] = &connStats{
+		clientID: clientID,
+		action:   action,
+		stream:   stream,
+		started:  started,
+	}
+}
+
+// addTrackStats 记录连接的一个 track, 连接没有统计时忽略
+func addTrackStats(peerConnection *webrtc.PeerConnection, track stats.Track) {
+	peerStatsLock.Lock()
+	c := peerStats[peerConnection]
+	peerStatsLock.Unlock()
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.tracks = append(c.tracks, track)
+	c.mu.Unlock()
+}
+
+// clientOf 连接所属的客户端 ID, 连接没有统计或已经关闭时为空
+func clientOf(peerConnection *webrtc.PeerConnection) string {
+	peerStatsLock.Lock()
+	defer peerStatsLock.Unlock()
+	if c := peerStats[peerConnection]; c != nil {
+		return c.clientID
+	}
+	return ""
+}
+
+// collectStats 返回所有会话当前连接的统计, 按 clientID 排序
+func collectStats() []sessionStats {
+	current := peers.peerConnections()
+
+	peerStatsLock.Lock()
+	conns := make(map[*webrtc.PeerConnection]*connStats)
+	for pc, c := range peerStats {
+		if pc.ICEConnectionState() == webrtc.ICEConnectionStateClosed {
+			delete(peerStats, pc)
+			continue
+		}
+		if current[pc] {
+			conns[pc] = c
+		}
+	}
+	peerStatsLock.Unlock()
+
+	result := make([]sessionStats, 0, len(conns))
+	for pc, c := range conns {
+		result = append(result, c.snapshot(pc))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ClientID < result[j].ClientID })
+	return result
+}
+
+// snapshot 读取连接和 track 当前的统计
+func (c *connStats) snapshot(peerConnection *webrtc.PeerConnection) sessionStats {
+	s := sessionStats{
+		ClientID:      c.clientID,
+		Action:        c.action,
+		Stream:        c.stream,
+		Started:       c.started,
+		ICEState:      peerConnection.ICEConnectionState().String(),
+		CandidatePair: selectedCandidatePair(peerConnection),
+		Tracks:        []stats.TrackStats{},
+	}
+	c.mu.Lock()
+	tracks := c.tracks
+	c.mu.Unlock()
+	for _, t := range tracks {
+		ts := t.Snapshot()
+		if ts.Direction == stats.DirectionInbound {
+			s.BytesReceived += ts.Bytes
+		} else {
+			s.BytesSent += ts.Bytes
+		}
+		s.Tracks = append(s.Tracks, ts)
+	}
+	return s
+}
+
+// selectedCandidatePair 连接选中的 candidate pair, 还没有连接时返回 nil
+func selectedCandidatePair(peerConnection *webrtc.PeerConnection) *candidatePairStats {
+	report := peerConnection.GetStats()
+	for _, s := range report {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated {
+			continue
+		}
+		local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+		remote, ok := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+		return &candidatePairStats{Local: candidateInfo(local), Remote: candidateInfo(remote)}
+	}
+	return nil
+}
+
+func candidateInfo(c webrtc.ICECandidateStats) candidateStats {
+	return candidateStats{IP: c.IP, Port: c.Port, Protocol: c.Protocol, Type: c.CandidateType.String()}
+}
+
+// serveStats 返回所有会话的统计, ?id= 只返回一个会话
+//
+//	GET /stats
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	all := collectStats()
+	if id := r.URL.Query().Get("id"); id != "" {
+		found := all[:0]
+		for _, s := range all {
+			if s.ClientID == id {
+				found = append(found, s)
+			}
+		}
+		if len(found) == 0 {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		all = found
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sessions []sessionStats `json:"sessions"`
+	}{all})
+}
+
+// serveMetrics 返回 Prometheus 文本格式的统计
+//
+//	GET /metrics
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	all := collectStats()
+	m := stats.NewMetrics()
+	m.Add("webrtc_sessions", stats.Gauge, "Number of connected sessions.", float64(len(all)))
+	for _, s := range all {
+		for _, t := range s.Tracks {
+			labels := []string{
+				"client_id", s.ClientID,
+				"action", string(s.Action),
+				"direction", t.Direction,
+				"kind", t.Kind,
+				"ssrc", strconv.FormatUint(uint64(t.SSRC), 10),
+			}
+			m.Add("webrtc_track_packets_total", stats.Counter, "RTP packets of a track.", float64(t.Packets), labels...)
+			m.Add("webrtc_track_bytes_total", stats.Counter, "RTP payload bytes of a track.", float64(t.Bytes), labels...)
+			m.Add("webrtc_track_packets_lost", stats.Gauge, "Cumulative packets lost, reported by the receiver for outbound tracks.", float64(t.PacketsLost), labels...)
+			m.Add("webrtc_track_fraction_lost", stats.Gauge, "Fraction of packets lost in the last interval.", t.FractionLost, labels...)
+			m.Add("webrtc_track_jitter_seconds", stats.Gauge, "Interarrival jitter.", t.Jitter, labels...)
+			m.Add("webrtc_track_bitrate_bps", stats.Gauge, "Bitrate over the last second.", float64(t.Bitrate), labels...)
+			m.Add("webrtc_track_frame_rate", stats.Gauge, "Frames per second over the last second.", t.FrameRate, labels...)
+			if t.RTT > 0 {
+				m.Add("webrtc_track_rtt_seconds", stats.Gauge, "Round trip time from receiver reports.", t.RTT, labels...)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// pushStats 定时给通过信令连接的浏览器发送 stats 消息, msg 为会话统计的 JSON
+//
+// WHIP/WHEP 和 REST 的客户端没有 channel 信令连接, 不发送
+func pushStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, s := range collectStats() {
+			if !channelSession(s.ClientID) {
+				continue
+			}
+			b, err := json.Marshal(s)
+			if err != nil {
+				logger.Error("统计编码出错", "client", s.ClientID, "error", err)
+				continue
+			}
+			client.Emit("messageToBrowser", signal.Message{
+				Type: "stats",
+				From: mac,
+				To:   s.ClientID,
+				Msg:  string(b),
+			})
+		}
+	}
+}
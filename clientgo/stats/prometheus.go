@@ -0,0 +1,85 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Metric types of the Prometheus text format
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// Metrics collects samples and writes them in the Prometheus text
+// exposition format, families are written in the order they were added.
+// A Metrics is built for one scrape and is not safe for concurrent use.
+type Metrics struct {
+	families []*family
+	index    map[string]*family
+}
+
+type family struct {
+	name, kind, help string
+	samples          []string
+}
+
+// NewMetrics returns an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{index: make(map[string]*family)}
+}
+
+// Add records a sample of the metric name. kind and help describe the
+// metric the first time it is added, labels are name, value pairs.
+func (m *Metrics) Add(name, kind, help string, value float64, labels ...string) {
+	f := m.index[name]
+	if f == nil {
+		f = &family{name: name, kind: kind, help: help}
+		m.index[name] = f
+		m.families = append(m.families, f)
+	}
+	sample := name
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+		}
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	f.samples = append(f.samples, sample+" "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// WriteTo writes the metrics to w
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, f := range m.families {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		for _, sample := range f.samples {
+			n, err = io.WriteString(w, sample+"\n")
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
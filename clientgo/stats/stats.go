@@ -0,0 +1,284 @@
+// Package stats keeps the statistics of RTP tracks the way RFC 3550
+// defines them, for the tracks the device receives and the tracks it sends.
+//
+// Inbound tracks are measured from the packets read off the connection.
+// Outbound tracks count the packets written to the connection and take
+// loss, jitter and round trip time from the receiver reports of the remote
+// peer. Bitrate and frame rate are measured over windows of about a second.
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// Direction of a track, seen from the device
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+const (
+	// window is the length of the bitrate and frame rate measurement
+	window = time.Second
+
+	// staleAfter is how long rates are reported without new packets,
+	// a track that stopped sending has a zero bitrate
+	staleAfter = 3 * window
+
+	// ntpEpochOffset is the number of seconds between 1900 and 1970
+	ntpEpochOffset = 2208988800
+)
+
+// Track is a track whose statistics can be read
+type Track interface {
+	Snapshot() TrackStats
+}
+
+// TrackStats is a snapshot of the statistics of a track. Jitter and RTT
+// are in seconds, Bitrate in bps.
+type TrackStats struct {
+	SSRC      uint32 `json:"ssrc"`
+	Kind      string `json:"kind"`
+	Codec     string `json:"codec"`
+	Direction string `json:"direction"`
+
+	Packets      uint64  `json:"packets"`
+	Bytes        uint64  `json:"bytes"`
+	PacketsLost  int64   `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	Jitter       float64 `json:"jitter"`
+	RTT          float64 `json:"rtt,omitempty"`
+	Bitrate      int     `json:"bitrate"`
+	FrameRate    float64 `json:"frameRate"`
+}
+
+// rates measures the bitrate and the frame rate of a track. A frame is a
+// run of packets sharing a timestamp.
+type rates struct {
+	started     bool
+	lastTS      uint32
+	bytes       int
+	frames      int
+	windowStart time.Time
+	lastPacket  time.Time
+	bitrate     int
+	frameRate   float64
+}
+
+// onPacket counts a packet, it returns true when a window is complete
+func (r *rates) onPacket(now time.Time, timestamp uint32, size int) bool {
+	if !r.started || timestamp != r.lastTS {
+		r.frames++
+		r.lastTS = timestamp
+	}
+	if !r.started {
+		r.started = true
+		r.windowStart = now
+	}
+	r.bytes += size
+	r.lastPacket = now
+	elapsed := now.Sub(r.windowStart)
+	if elapsed < window {
+		return false
+	}
+	r.bitrate = int(float64(r.bytes*8) / elapsed.Seconds())
+	r.frameRate = float64(r.frames) / elapsed.Seconds()
+	r.bytes, r.frames = 0, 0
+	r.windowStart = now
+	return true
+}
+
+// read returns the rates of the last complete window
+func (r *rates) read(now time.Time) (int, float64) {
+	if !r.started || now.Sub(r.lastPacket) > staleAfter {
+		return 0, 0
+	}
+	return r.bitrate, r.frameRate
+}
+
+// Inbound is the statistics of a received track. It is safe for
+// concurrent use.
+type Inbound struct {
+	ssrc      uint32
+	kind      string
+	codec     string
+	clockRate float64
+
+	mu      sync.Mutex
+	packets uint64
+	bytes   uint64
+	started bool
+	// baseSeq is the first sequence number, maxSeq the highest one
+	// extended with the number of wrap arounds
+	baseSeq uint32
+	maxSeq  uint32
+	// transit and jitter are in timestamp units
+	transit float64
+	jitter  float64
+	rates   rates
+	// loss of the last complete window
+	windowExpected uint32
+	windowPackets  uint64
+	fractionLost   float64
+}
+
+// NewInbound returns the statistics of a received track of kind, audio
+// or video, encoded with codec
+func NewInbound(ssrc uint32, kind, codec string, clockRate uint32) *Inbound {
+	return &Inbound{ssrc: ssrc, kind: kind, codec: codec, clockRate: float64(clockRate)}
+}
+
+// OnPacket records a packet of size bytes received at arrival
+func (s *Inbound) OnPacket(arrival time.Time, header *rtp.Header, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets++
+	s.bytes += uint64(size)
+
+	if !s.started {
+		s.started = true
+		s.baseSeq = uint32(header.SequenceNumber)
+		s.maxSeq = s.baseSeq
+		s.windowExpected = s.baseSeq
+	} else if diff := int16(header.SequenceNumber - uint16(s.maxSeq)); diff > 0 {
+		// int16 handles the wrap around, late packets do not move maxSeq
+		s.maxSeq += uint32(diff)
+	}
+
+	if s.clockRate > 0 {
+		// RFC 3550 A.8
+		transit := float64(arrival.UnixNano())/float64(time.Second)*s.clockRate - float64(header.Timestamp)
+		if s.packets > 1 {
+			d := transit - s.transit
+			if d < 0 {
+				d = -d
+			}
+			s.jitter += (d - s.jitter) / 16
+		}
+		s.transit = transit
+	}
+
+	if s.rates.onPacket(arrival, header.Timestamp, size) {
+		expected := s.maxSeq + 1 - s.windowExpected
+		received := s.packets - s.windowPackets
+		s.fractionLost = 0
+		if expected > 0 && uint64(expected) > received {
+			s.fractionLost = float64(uint64(expected)-received) / float64(expected)
+		}
+		s.windowExpected = s.maxSeq + 1
+		s.windowPackets = s.packets
+	}
+}
+
+// Snapshot returns the current statistics
+func (s *Inbound) Snapshot() TrackStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := TrackStats{
+		SSRC:         s.ssrc,
+		Kind:         s.kind,
+		Codec:        s.codec,
+		Direction:    DirectionInbound,
+		Packets:      s.packets,
+		Bytes:        s.bytes,
+		FractionLost: s.fractionLost,
+	}
+	if s.started {
+		t.PacketsLost = int64(s.maxSeq-s.baseSeq+1) - int64(s.packets)
+	}
+	if s.clockRate > 0 {
+		t.Jitter = s.jitter / s.clockRate
+	}
+	t.Bitrate, t.FrameRate = s.rates.read(time.Now())
+	return t
+}
+
+// Outbound is the statistics of a sent track. It is safe for concurrent
+// use.
+type Outbound struct {
+	ssrc      uint32
+	kind      string
+	codec     string
+	clockRate float64
+
+	mu      sync.Mutex
+	packets uint64
+	bytes   uint64
+	rates   rates
+	// from the last receiver report
+	packetsLost  int64
+	fractionLost float64
+	jitter       float64
+	rtt          float64
+}
+
+// NewOutbound returns the statistics of a sent track of kind, audio or
+// video, encoded with codec
+func NewOutbound(ssrc uint32, kind, codec string, clockRate uint32) *Outbound {
+	return &Outbound{ssrc: ssrc, kind: kind, codec: codec, clockRate: float64(clockRate)}
+}
+
+// SSRC returns the SSRC of the track
+func (s *Outbound) SSRC() uint32 {
+	return s.ssrc
+}
+
+// OnPacket records a packet with size bytes of payload sent at now
+func (s *Outbound) OnPacket(now time.Time, timestamp uint32, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets++
+	s.bytes += uint64(size)
+	s.rates.onPacket(now, timestamp, size)
+}
+
+// OnReceptionReport records the report block of the track from a receiver
+// report received at now. The round trip time is measured when the report
+// refers to a sender report of the device.
+func (s *Outbound) OnReceptionReport(report rtcp.ReceptionReport, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetsLost = int64(report.TotalLost)
+	s.fractionLost = float64(report.FractionLost) / 256
+	if s.clockRate > 0 {
+		s.jitter = float64(report.Jitter) / s.clockRate
+	}
+	if report.LastSenderReport != 0 {
+		// RFC 3550 6.4.1, in units of 1/65536 seconds
+		rtt := compactNTP(now) - report.LastSenderReport - report.Delay
+		if int32(rtt) >= 0 {
+			s.rtt = float64(rtt) / 65536
+		}
+	}
+}
+
+// Snapshot returns the current statistics
+func (s *Outbound) Snapshot() TrackStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := TrackStats{
+		SSRC:         s.ssrc,
+		Kind:         s.kind,
+		Codec:        s.codec,
+		Direction:    DirectionOutbound,
+		Packets:      s.packets,
+		Bytes:        s.bytes,
+		PacketsLost:  s.packetsLost,
+		FractionLost: s.fractionLost,
+		Jitter:       s.jitter,
+		RTT:          s.rtt,
+	}
+	t.Bitrate, t.FrameRate = s.rates.read(time.Now())
+	return t
+}
+
+// compactNTP returns the middle 32 bits of the NTP timestamp of t
+func compactNTP(t time.Time) uint32 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32((seconds<<32 | fraction) >> 16)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"clientgo/simulcast"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+var (
+	// 直播流, key 为流名称, 推流端的视频由 relay 转发给所有拉流端
+	// socket.io 推拉流使用设备 mac 作为流名称
+	streams     = make(map[string]*stream)
+	streamsLock sync.Mutex
+
+	errStreamNotFound = errors.New("stream not found")
+)
+
+// stream 一路直播流
+//
+// 推流端的每个 simulcast 层是一个 layer, 没有 simulcast 时只有 high 层.
+// 每个拉流端有自己的 track, 按请求的画质和带宽选择 layer, 在关键帧切换.
+// 推流端断开后流保留, 重新推流时拉流端不需要重新连接.
+// 推流端 SR 的时间戳对应关系转换成设备的时间后, 在拉流端的 SR 中继续使用, 拉流端可以同步音视频
+type stream struct {
+	name string
+
+	mu      sync.Mutex
+	layers  map[string]*layer
+	viewers map[*viewer]struct{}
+	// publisher 推流的连接, 换推流端后重新计算 clockOffset
+	publisher *webrtc.PeerConnection
+	// clockOffset 推流端 SR 的时间加上 clockOffset 为设备的时间, 音视频使用同一个差值
+	clockOffset time.Duration
+	hasOffset   bool
+	// audioMapping 推流端音频 SR 的对应关系, 没有收到 SR 时为 nil
+	audioMapping *clockMapping
+}
+
+// layer 推流端的一个 simulcast 层
+type layer struct {
+	stream  *stream
+	quality string
+
+	mu sync.Mutex
+	// pli 请求推流端发送这一层的关键帧
+	pli func()
+	// 每秒统计一次码率
+	bytes       int
+	windowStart time.Time
+	bitrate     int
+	// mapping 推流端 SR 的对应关系, 没有收到 SR 时为 nil
+	mapping *clockMapping
+}
+
+// publishStream 返回流的 quality 层, 第一次推流时创建流
+//
+// 推流端的 track 由返回的 layer 转发, 重新推流时这一层的拉流端等待新的关键帧
+func publishStream(name, quality string, peerConnection *webrtc.PeerConnection, remote *webrtc.Track) *layer {
+	s := getStream(name)
+	ssrc := remote.SSRC()
+	pli := func() {
+		peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+	}
+	s.mu.Lock()
+	s.setPublisherLocked(peerConnection)
+	l := s.layers[quality]
+	if l == nil {
+		l = &layer{stream: s, quality: quality, windowStart: time.Now()}
+		s.layers[quality] = l
+	}
+	viewers := s.viewerList()
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	l.pli = pli
+	l.mu.Unlock()
+	for _, v := range viewers {
+		v.resync(quality)
+		s.selectLayer(v)
+	}
+	return l
+}
+
+// getStream 返回直播流, 第一次推流时创建
+func getStream(name string) *stream {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	s := streams[name]
+	if s == nil {
+		s = &stream{
+			name:    name,
+			layers:  make(map[string]*layer),
+			viewers: make(map[*viewer]struct{}),
+		}
+		streams[name] = s
+	}
+	return s
+}
+
+// setPublisherLocked 换推流端后丢弃之前推流端的 SR, 调用时需要持有 s.mu
+func (s *stream) setPublisherLocked(peerConnection *webrtc.PeerConnection) {
+	if s.publisher == peerConnection {
+		return
+	}
+	s.publisher = peerConnection
+	s.hasOffset = false
+	s.audioMapping = nil
+	for _, l := range s.layers {
+		l.mu.Lock()
+		l.mapping = nil
+		l.mu.Unlock()
+	}
+}
+
+// senderMapping 把推流端 SR 的对应关系转换成设备的时间
+func (s *stream) senderMapping(sr *rtcp.SenderReport, clockRate uint32) clockMapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := fromNTP(sr.NTPTime)
+	if !s.hasOffset {
+		s.clockOffset = time.Since(sent)
+		s.hasOffset = true
+	}
+	return clockMapping{ntp: sent.Add(s.clockOffset), rtp: sr.RTPTime, clockRate: clockRate}
+}
+
+// onSenderReport 收到推流端这一层的 SR
+func (l *layer) onSenderReport(sr *rtcp.SenderReport) {
+	mapping := l.stream.senderMapping(sr, videoClockRate)
+	l.mu.Lock()
+	l.mapping = &mapping
+	l.mu.Unlock()
+}
+
+// clockMapping 包的时间戳和时间的对应关系
+func (l *layer) clockMapping(packet *rtp.Packet) clockMapping {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mapping != nil {
+		return *l.mapping
+	}
+	return localMapping(packet, videoClockRate)
+}
+
+// WriteRTP 转发推流端的包给选择了这一层的拉流端
+func (l *layer) WriteRTP(packet *rtp.Packet) error {
+	if l.count(len(packet.Payload)) {
+		// 码率变化后按带宽重新选择
+		for _, v := range l.stream.viewerSnapshot() {
+			l.stream.selectLayer(v)
+		}
+	}
+	keyframe := isVP8Keyframe(packet.Payload)
+	mapping := l.clockMapping(packet)
+	for _, v := range l.stream.viewerSnapshot() {
+		if err := v.forward(l.quality, packet, keyframe, mapping); err != nil {
+			// 拉流端的连接已经关闭
+			l.stream.removeViewer(v)
+		}
+	}
+	return nil
+}
+
+// count 统计码率, 返回是否完成了一秒的统计
+func (l *layer) count(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes += n
+	elapsed := time.Since(l.windowStart)
+	if elapsed < time.Second {
+		return false
+	}
+	l.bitrate = int(float64(l.bytes*8) / elapsed.Seconds())
+	l.bytes = 0
+	l.windowStart = time.Now()
+	return true
+}
+
+// Bitrate 最近一秒的码率, bps
+func (l *layer) Bitrate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bitrate
+}
+
+// requestKeyframe 请求推流端发送这一层的关键帧
+func (l *layer) requestKeyframe() {
+	l.mu.Lock()
+	pli := l.pli
+	l.mu.Unlock()
+	if pli != nil {
+		pli()
+	}
+}
+
+// pullFromStream 给拉流端创建 track, 从 quality 层转发, bandwidth 大于 0 时选择码率不超过 bandwidth kbps 的层.
+// 配置了 -max-session-bitrate 时 bandwidth 不超过它
+//
+// 拉流端协商了 opus 时同时转发推流端的音频
+func pullFromStream(peerConnection *webrtc.PeerConnection, name, quality string, bandwidth int) error {
+	streamsLock.Lock()
+	s := streams[name]
+	streamsLock.Unlock()
+	if s == nil {
+		return errStreamNotFound
+	}
+	track, err := peerConnection.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), "video", name)
+	if err != nil {
+		return err
+	}
+	sender, err := peerConnection.AddTrack(track)
+	if err != nil {
+		return err
+	}
+	// 没有协商 opus 时 NewTrack 返回 ErrCodecNotFound, 只转发视频
+	audio, err := peerConnection.NewTrack(webrtc.DefaultPayloadTypeOpus, rand.Uint32(), "audio", name)
+	if err == nil {
+		if _, err = peerConnection.AddTrack(audio); err != nil {
+			return err
+		}
+	} else {
+		audio = nil
+	}
+	v := newViewer(track, audio, quality, limitBandwidth(bandwidth))
+	v.clientID = clientOf(peerConnection)
+	addTrackStats(peerConnection, v.videoReport.stats)
+	if v.audioReport != nil {
+		addTrackStats(peerConnection, v.audioReport.stats)
+	}
+	s.mu.Lock()
+	s.viewers[v] = struct{}{}
+	s.mu.Unlock()
+	s.selectLayer(v)
+	go s.readRTCP(v, sender)
+	go sendReports(peerConnection, v.videoReport, v.audioReport)
+	return nil
+}
+
+// publishAudio 返回转发流的音频的 streamAudio
+func publishAudio(name string, peerConnection *webrtc.PeerConnection) streamAudio {
+	s := getStream(name)
+	s.mu.Lock()
+	s.setPublisherLocked(peerConnection)
+	s.mu.Unlock()
+	return streamAudio{s}
+}
+
+// streamAudio 把推流端的音频转发给所有拉流端
+type streamAudio struct {
+	stream *stream
+}
+
+func (a streamAudio) WriteRTP(packet *rtp.Packet) error {
+	a.stream.mu.Lock()
+	mapping := a.stream.audioMapping
+	a.stream.mu.Unlock()
+	if mapping == nil {
+		local := localMapping(packet, audioClockRate)
+		mapping = &local
+	}
+	for _, v := range a.stream.viewerSnapshot() {
+		if err := v.forwardAudio(packet, *mapping); err != nil {
+			a.stream.removeViewer(v)
+		}
+	}
+	return nil
+}
+
+// onSenderReport 收到推流端音频的 SR
+func (a streamAudio) onSenderReport(sr *rtcp.SenderReport) {
+	mapping := a.stream.senderMapping(sr, audioClockRate)
+	a.stream.mu.Lock()
+	a.stream.audioMapping = &mapping
+	a.stream.mu.Unlock()
+}
+
+// selectLayer 为拉流端选择 layer: 不超过请求画质的最高层, 有可用带宽时还要求码率不超过带宽,
+// 都不满足时选择最低的层. 带宽不够最低的一层时只转发关键帧, 带宽更低时暂停视频
+func (s *stream) selectLayer(v *viewer) {
+	quality, bandwidth := v.request()
+	s.mu.Lock()
+	best, lowest := "", ""
+	for name, l := range s.layers {
+		if quality != "" && simulcast.Rank(name) > simulcast.Rank(quality) {
+			continue
+		}
+		if lowest == "" || simulcast.Rank(name) < simulcast.Rank(lowest) {
+			lowest = name
+		}
+		if bandwidth > 0 && l.Bitrate() > bandwidth {
+			continue
+		}
+		if best == "" || simulcast.Rank(name) > simulcast.Rank(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		best = lowest
+	}
+	if best == "" {
+		// 请求的画质比所有层都低
+		best = s.lowestLayer()
+	}
+	target := s.layers[best]
+	s.mu.Unlock()
+	if target == nil {
+		return
+	}
+
+	mode := modeNormal
+	if bitrate := target.Bitrate(); bandwidth > 0 && bitrate > bandwidth {
+		mode = modePaused
+		if float64(bandwidth) >= float64(bitrate)*keyframesRatio {
+			mode = modeKeyframes
+		}
+	}
+	if v.setTarget(best, mode) {
+		target.requestKeyframe()
+	}
+}
+
+// requestKeyframe 请求推流端发送 quality 层的关键帧
+func (s *stream) requestKeyframe(quality string) {
+	s.mu.Lock()
+	l := s.layers[quality]
+	s.mu.Unlock()
+	if l != nil {
+		l.requestKeyframe()
+	}
+}
+
+// lowestLayer 最低的层, 调用时需要持有 s.mu
+func (s *stream) lowestLayer() string {
+	lowest := ""
+	for name := range s.layers {
+		if lowest == "" || simulcast.Rank(name) < simulcast.Rank(lowest) {
+			lowest = name
+		}
+	}
+	return lowest
+}
+
+func (s *stream) viewerSnapshot() []*viewer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.viewerList()
+}
+
+// viewerList 调用时需要持有 s.mu
+func (s *stream) viewerList() []*viewer {
+	viewers := make([]*viewer, 0, len(s.viewers))
+	for v := range s.viewers {
+		viewers = append(viewers, v)
+	}
+	return viewers
+}
+
+func (s *stream) removeViewer(v *viewer) {
+	s.mu.Lock()
+	delete(s.viewers, v)
+	s.mu.Unlock()
+}
+
+// simulcastLayer 推流端 track 所在的 simulcast 层, 没有 simulcast 时为 high
+func simulcastLayer(peerConnection *webrtc.PeerConnection, ssrc uint32) string {
+	remote := peerConnection.RemoteDescription()
+	if remote == nil {
+		return simulcast.High
+	}
+	_, layers, err := simulcast.Prepare(remote.SDP)
+	if err != nil {
+		return simulcast.High
+	}
+	for _, l := range layers {
+		if l.SSRC == ssrc {
+			return l.Quality
+		}
+	}
+	return simulcast.High
+}
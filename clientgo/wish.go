@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"clientgo/auth"
+	"clientgo/signal"
+	"clientgo/simulcast"
+	"clientgo/wish"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+// wishSessions WHIP/WHEP 共用的会话管理
+//
+// WHIP/WHEP 的会话 ID 和 socket.ID 一样作为 peers 的 key. socket.ID 对房间里的其他客户端可见,
+// 所以每个 endpoint 只能 PATCH 和 DELETE 自己创建的会话, 其他 ID 返回 404.
+// PATCH 和 DELETE 需要和创建会话时同样权限的 Bearer token
+type wishSessions struct {
+	perm auth.Permission
+
+	mu sync.Mutex
+	// pcs endpoint 创建的会话, 会话关闭或者 pc 被替换后作废
+	pcs map[string]*webrtc.PeerConnection
+}
+
+func newWISHSessions(perm auth.Permission) *wishSessions {
+	return &wishSessions{perm: perm, pcs: make(map[string]*webrtc.PeerConnection)}
+}
+
+// remember 记录 endpoint 创建的会话, 同时删除已经关闭的会话
+func (s *wishSessions) remember(id string, peerConnection *webrtc.PeerConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for other, pc := range s.pcs {
+		if !peers.isCurrent(other, pc) {
+			delete(s.pcs, other)
+		}
+	}
+	s.pcs[id] = peerConnection
+}
+
+// lookup 返回 endpoint 创建并且没有关闭的会话的 pc, 其他 ID 返回 nil
+func (s *wishSessions) lookup(id string) *webrtc.PeerConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc := s.pcs[id]
+	if pc != nil && !peers.isCurrent(id, pc) {
+		delete(s.pcs, id)
+		return nil
+	}
+	return pc
+}
+
+func (s *wishSessions) AddICECandidate(id string, r *http.Request, candidate webrtc.ICECandidateInit) error {
+	if err := authorizeBearer(r, s.perm); err != nil {
+		return err
+	}
+	pc := s.lookup(id)
+	if pc == nil {
+		return wish.ErrNotFound
+	}
+	return pc.AddICECandidate(candidate)
+}
+
+func (s *wishSessions) Close(id string, r *http.Request) error {
+	if err := authorizeBearer(r, s.perm); err != nil {
+		return err
+	}
+	if s.lookup(id) == nil || !closePeerConnection(id) {
+		return wish.ErrNotFound
+	}
+	return nil
+}
+
+// whipBackend 通过 WHIP 接收推流, 和 "push to file and stream" 走同一条保存和分发路径
+type whipBackend struct {
+	*wishSessions
+}
+
+func (b whipBackend) Offer(id, stream string, r *http.Request, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := authorizeBearer(r, auth.PermPush); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return b.create(id, signal.ActionPushToFileAndStream, stream, usage{publisher: true}, offer, func(peerConnection *webrtc.PeerConnection) error {
+		return pushToFileAndStream(peerConnection, id, streamName(stream), true)
+	})
+}
+
+// whepBackend 通过 WHEP 拉取直播流, 和 "pull from stream" 走同一条分发路径
+type whepBackend struct {
+	*wishSessions
+}
+
+func (b whepBackend) Offer(id, stream string, r *http.Request, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := authorizeBearer(r, auth.PermPullLive); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return b.create(id, signal.ActionPullFromStream, stream, usage{streams: []string{streamName(stream)}}, offer, func(peerConnection *webrtc.PeerConnection) error {
+		if err := pullFromStream(peerConnection, streamName(stream), "", 0); err != nil {
+			if err == errStreamNotFound {
+				return wish.ErrStreamNotFound
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// streamName 没有指定流名称时使用设备的直播流
+func streamName(stream string) string {
+	if stream == "" {
+		return mac
+	}
+	return stream
+}
+
+// create 创建连接, 由 setup 添加收发的媒体, 然后回复 answer. action 和 stream 用于统计,
+// 连接占用 u 后超过资源上限时返回 wish.ErrUnavailable
+func (s *wishSessions) create(id string, action signal.Action, stream string, u usage, offer webrtc.SessionDescription, setup func(*webrtc.PeerConnection) error) (webrtc.SessionDescription, error) {
+	if isShuttingDown() {
+		return webrtc.SessionDescription{}, wish.ErrUnavailable
+	}
+	if err := peers.check(id, u); err != nil {
+		logger.Warn("连接被拒绝", "client", id, "error", err)
+		return webrtc.SessionDescription{}, wish.ErrUnavailable
+	}
+	peerConnection, err := sessionAPI(&signal.ConnectRequest{}).NewPeerConnection(config)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	watchPeerConnection(peerConnection, id, action, streamName(stream), time.Now())
+	log := clientLogger(id, action)
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		logICEState(log, connectionState)
+		if connectionState == webrtc.ICEConnectionStateFailed {
+			closePeerConnection(id)
+		}
+	})
+	if err = setup(peerConnection); err != nil {
+		peerConnection.Close()
+		return webrtc.SessionDescription{}, err
+	}
+	answer, err := answerOffer(peerConnection, offer)
+	if err != nil {
+		peerConnection.Close()
+		return webrtc.SessionDescription{}, err
+	}
+	if err = peers.add(id, peerConnection, u); err != nil {
+		peerConnection.Close()
+		if signal.CodeOf(err) == signal.CodeLimitExceeded {
+			logger.Warn("连接被拒绝", "client", id, "error", err)
+		}
+		return webrtc.SessionDescription{}, wish.ErrUnavailable
+	}
+	s.remember(id, peerConnection)
+	return answer, nil
+}
+
+// answerOffer 设置远端 offer 并生成本地 answer
+//
+// offer 使用 simulcast 时, 每多一层添加一个接收视频的 transceiver, 每一层作为一个 track 接收
+func answerOffer(peerConnection *webrtc.PeerConnection, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	sdp, layers, err := simulcast.Prepare(offer.SDP)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	for i := 1; i < len(layers); i++ {
+		if _, err = peerConnection.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+	}
+	offer.SDP = sdp
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return answer, nil
+}
+
+// closePeerConnection 关闭并移除一个连接, 连接不存在时返回 false
+func closePeerConnection(id string) bool {
+	pc, sess := peers.remove(id)
+	revokeGrant(id)
+	dropSealKey(id)
+	if sess != nil {
+		sess.close()
+	}
+	// 会话的 track 结束时不关闭文件, 见 recordingTrack
+	closeRecording(id)
+	if pc == nil {
+		return false
+	}
+	if err := pc.Close(); err != nil {
+		logger.Warn("关闭连接出错", "client", id, "error", err)
+	}
+	return true
+}
+
+// httpServer WHIP/WHEP 服务, 关闭设备时需要调用 Shutdown
+var httpServer *http.Server
+
+// serveHTTP 启动 WHIP/WHEP、统计和管理接口
+//
+//	推流 POST /whip/{stream}
+//	拉流 POST /whep/{stream}
+//	统计 GET /stats, GET /metrics
+//	管理 /admin/, 见 serveAdmin
+//
+// 统计包含所有客户端和 WHIP/WHEP 会话的 ID 以及 candidate 的地址, 知道 WHIP/WHEP 会话 ID 就可以关闭会话,
+// 所以统计和管理接口一样需要管理 token, 没有配置 -admin-token-file 时都不提供
+//
+// 不指定 stream 时为设备的直播流, 和 socket.io 推拉流相同
+func serveHTTP(addr string) {
+	whip := wish.NewWHIPEndpoint("/whip", whipBackend{newWISHSessions(auth.PermPush)})
+	whep := wish.NewWHEPEndpoint("/whep", whepBackend{newWISHSessions(auth.PermPullLive)})
+	mux := http.NewServeMux()
+	mux.Handle("/whip", whip)
+	mux.Handle("/whip/", whip)
+	mux.Handle("/whep", whep)
+	mux.Handle("/whep/", whep)
+	if adminToken != nil {
+		mux.HandleFunc("/stats", requireAdmin(serveStats))
+		mux.HandleFunc("/metrics", requireAdmin(serveMetrics))
+		mux.HandleFunc("/admin/", requireAdmin(serveAdmin))
+	}
+	httpServer = &http.Server{Addr: addr, Handler: mux}
+	logger.Info("WHIP/WHEP 服务启动", "addr", addr)
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error("WHIP/WHEP 服务出错", "error", err)
+	}
+}
@@ -0,0 +1,254 @@
+// Package wish implements the HTTP signaling defined by the IETF WISH
+// working group: WHIP for publishers pushing media into the device and
+// WHEP for players pulling media out of it.
+//
+// Both protocols share the same shape. An offer is POSTed to the endpoint
+// of a stream, {prefix}/{stream}, and answered with 201 Created and the
+// Location of the new session resource, {prefix}/{stream}/{id}. PATCH on
+// the resource trickles ICE candidates and DELETE ends the session.
+//
+// An Endpoint only speaks the HTTP side of the protocol. Creating the
+// PeerConnection, answering the offer and tearing it down again is left
+// to a Backend, so the same media path can be shared with other signaling.
+package wish
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	contentTypeSDP     = "application/sdp"
+	contentTypeSDPFrag = "application/trickle-ice-sdpfrag"
+
+	// maxBodySize bounds offers and trickle fragments read from a request
+	maxBodySize = 1 << 20
+)
+
+var (
+	// ErrNotFound is returned by a Backend when a session id is unknown
+	ErrNotFound = errors.New("wish: session not found")
+
+	// ErrStreamNotFound is returned by a Backend when an offer targets a
+	// stream that does not exist
+	ErrStreamNotFound = errors.New("wish: stream not found")
+
+	// ErrUnauthorized is returned by a Backend when the bearer token of a
+	// request is missing or does not allow the request
+	ErrUnauthorized = errors.New("wish: unauthorized")
+
+	// ErrUnavailable is returned by a Backend that does not accept new
+	// sessions, for example while shutting down
+	ErrUnavailable = errors.New("wish: service unavailable")
+)
+
+// Backend creates and controls the sessions behind an Endpoint
+//
+//	Offer answers the offer of a new session identified by id on stream
+//	AddICECandidate adds a remote candidate trickled by PATCH
+//	Close ends the session, it is called for DELETE
+//
+// r is the HTTP request, so the Backend can authorize it. AddICECandidate
+// and Close must return ErrNotFound for ids the Backend did not answer
+// an offer for.
+type Backend interface {
+	Offer(id, stream string, r *http.Request, offer webrtc.SessionDescription) (webrtc.SessionDescription, error)
+	AddICECandidate(id string, r *http.Request, candidate webrtc.ICECandidateInit) error
+	Close(id string, r *http.Request) error
+}
+
+// Endpoint is a http.Handler serving a WHIP or WHEP endpoint and the
+// session resources created by it
+type Endpoint struct {
+	prefix  string
+	backend Backend
+}
+
+// NewWHIPEndpoint builds a WHIP endpoint mounted at prefix
+func NewWHIPEndpoint(prefix string, backend Backend) *Endpoint {
+	return newEndpoint(prefix, backend)
+}
+
+// NewWHEPEndpoint builds a WHEP endpoint mounted at prefix
+func NewWHEPEndpoint(prefix string, backend Backend) *Endpoint {
+	return newEndpoint(prefix, backend)
+}
+
+func newEndpoint(prefix string, backend Backend) *Endpoint {
+	return &Endpoint{
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		backend: backend,
+	}
+}
+
+// ServeHTTP dispatches POST on the endpoint and PATCH/DELETE on session resources
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Accept-Post", contentTypeSDP)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// POST targets the endpoint of a stream, everything else a session resource
+	// whose id is the last path segment
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, e.prefix), "/")
+	id := path[strings.LastIndex(path, "/")+1:]
+	switch {
+	case r.Method == http.MethodPost:
+		e.serveOffer(w, r, path)
+	case id != "" && r.Method == http.MethodPatch:
+		e.serveTrickle(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		e.serveDelete(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (e *Endpoint) serveOffer(w http.ResponseWriter, r *http.Request, stream string) {
+	if !hasContentType(r, contentTypeSDP) {
+		http.Error(w, "content type must be "+contentTypeSDP, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	answer, err := e.backend.Offer(id, stream, r, webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(body),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeSDP)
+	location := e.prefix + "/" + id
+	if stream != "" {
+		location = e.prefix + "/" + stream + "/" + id
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, answer.SDP)
+}
+
+func (e *Endpoint) serveTrickle(w http.ResponseWriter, r *http.Request, id string) {
+	if !hasContentType(r, contentTypeSDPFrag) {
+		http.Error(w, "content type must be "+contentTypeSDPFrag, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, candidate := range parseSDPFrag(string(body)) {
+		if err = e.backend.AddICECandidate(id, r, candidate); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Endpoint) serveDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if err := e.backend.Close(id, r); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseSDPFrag extracts the candidates of a trickle-ice-sdpfrag body
+// https://tools.ietf.org/html/rfc8840
+func parseSDPFrag(frag string) []webrtc.ICECandidateInit {
+	var (
+		candidates []webrtc.ICECandidateInit
+		ufrag      string
+		mid        string
+		lineIndex  uint16
+		sections   int
+	)
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "m="):
+			lineIndex = uint16(sections)
+			sections++
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidateMid, candidateIndex := mid, lineIndex
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:        strings.TrimPrefix(line, "a="),
+				SDPMid:           &candidateMid,
+				SDPMLineIndex:    &candidateIndex,
+				UsernameFragment: ufrag,
+			})
+		}
+	}
+	return candidates
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotFound, ErrStreamNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case ErrUnavailable:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// BearerToken returns the token of the Authorization header of r, WHIP
+// and WHEP clients authenticate with "Authorization: Bearer <token>"
+func BearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), contentType)
+}
+
+// setCORSHeaders lets browser based players use the endpoint from another origin
+func setCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Accept-Post")
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clientgo/auth"
+	"clientgo/wish"
+
+	webrtc "github.com/pion/webrtc/v2"
+)
+
+const testCandidate = "a=candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host\r\n"
+
+// wishRequest 发送 PATCH 或 DELETE 请求, token 不为空时带 Bearer token, 返回状态码
+func wishRequest(t *testing.T, h http.Handler, method, path, token string) int {
+	body := ""
+	if method == http.MethodPatch {
+		body = testCandidate
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if method == http.MethodPatch {
+		r.Header.Set("Content-Type", "application/trickle-ice-sdpfrag")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+// WHIP/WHEP 不能 PATCH 或 DELETE 信令建立的会话, 知道 socket.ID 也不行
+func TestWISHRejectsSignalingSessions(t *testing.T) {
+	whip := wish.NewWHIPEndpoint("/whip", whipBackend{newWISHSessions(auth.PermPush)})
+	pc := startTestSession(t, "socket1")
+	defer closePeerConnection("socket1")
+
+	if code := wishRequest(t, whip, http.MethodPatch, "/whip/socket1", ""); code != http.StatusNotFound {
+		t.Errorf("PATCH returned %d, want 404", code)
+	}
+	if code := wishRequest(t, whip, http.MethodDelete, "/whip/socket1", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE returned %d, want 404", code)
+	}
+	if peers.peerConnection("socket1") != pc {
+		t.Errorf("signaling session was closed")
+	}
+}
+
+// 只有创建会话的 endpoint 可以关闭它, 需要同样权限的 token
+func TestWISHDeleteOwnSession(t *testing.T) {
+	oldSigner := authSigner
+	authSigner = auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	defer func() { authSigner = oldSigner }()
+	token := func(perm auth.Permission) string {
+		s, err := authSigner.Sign(auth.Claims{Device: mac, Perms: []auth.Permission{perm}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	sessions := newWISHSessions(auth.PermPush)
+	whip := wish.NewWHIPEndpoint("/whip", whipBackend{sessions})
+	whep := wish.NewWHEPEndpoint("/whep", whepBackend{newWISHSessions(auth.PermPullLive)})
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peers.add("whip1", pc, usage{publisher: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer closePeerConnection("whip1")
+	sessions.remember("whip1", pc)
+
+	if code := wishRequest(t, whip, http.MethodDelete, "/whip/whip1", ""); code != http.StatusUnauthorized {
+		t.Errorf("DELETE without token returned %d, want 401", code)
+	}
+	if code := wishRequest(t, whip, http.MethodDelete, "/whip/whip1", token(auth.PermPullLive)); code != http.StatusUnauthorized {
+		t.Errorf("DELETE with a pull token returned %d, want 401", code)
+	}
+	if code := wishRequest(t, whep, http.MethodDelete, "/whep/whip1", token(auth.PermPullLive)); code != http.StatusNotFound {
+		t.Errorf("DELETE on the other endpoint returned %d, want 404", code)
+	}
+	if peers.peerConnection("whip1") != pc {
+		t.Fatalf("session closed by an unauthorized request")
+	}
+	if code := wishRequest(t, whip, http.MethodDelete, "/whip/whip1", token(auth.PermPush)); code != http.StatusOK {
+		t.Errorf("DELETE returned %d, want 200", code)
+	}
+	if peers.peerConnection("whip1") != nil {
+		t.Errorf("session not closed")
+	}
+	if code := wishRequest(t, whip, http.MethodDelete, "/whip/whip1", token(auth.PermPush)); code != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d, want 404", code)
+	}
+}
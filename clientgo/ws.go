@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+
+	"clientgo/channel"
+	"clientgo/signal"
+)
+
+// dialWS 连接原生 WebSocket 信令服务 (cmd/channel), 事件和 socket.io 的 channel 服务相同
+func dialWS(url string, l *signalingLink) (signalingConn, error) {
+	ws, err := channel.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	ws.On(channel.EventConnect, func(data json.RawMessage) {
+		l.onConnected(ws)
+	})
+	ws.On(channel.EventCreated, func(data json.RawMessage) {
+		var room string
+		json.Unmarshal(data, &room)
+		l.onCreated(room)
+	})
+	// 客户端请求建立连接
+	ws.On(channel.EventAskToConnect, func(data json.RawMessage) {
+		var msg signal.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			logger.Warn("askToConnect 消息格式错误", "error", err)
+			return
+		}
+		l.onAskToConnect(msg)
+	})
+	ws.On(channel.EventMessageToDevice, func(data json.RawMessage) {
+		var msg signal.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			logger.Warn("messageToDevice 消息格式错误", "error", err)
+			return
+		}
+		l.onMessageToDevice(msg)
+	})
+	ws.OnDisconnect(l.onDisconnected)
+	go ws.Run()
+	return ws, nil
+}
@@ -1,9 +1,11 @@
 import React, {Component} from 'react';
 import './App.css';
 import io from 'socket.io-client'
+import ChannelSocket from './channel'
 import 'webrtc-adapter'
 import 'toastr/build/toastr.min.css'
 import toastr from 'toastr'
+import * as sealing from './seal'
 
 var pcConfig = {
     'iceServers': [
@@ -20,7 +22,70 @@ var pcConfig = {
     // "iceTransportPolicy": "relay"
 };
 
+// 访问设备的 token, 设备配置了密钥时需要, 通过页面地址 ?token=xxx 传入
+var token = new URLSearchParams(window.location.search).get("token") || undefined;
+// 信令加密模式, 和设备的 -seal 参数相同: ?seal=psk&sealKey=xxx 或 ?seal=ecdh
+var sealMode = new URLSearchParams(window.location.search).get("seal");
+var sealSecret = new URLSearchParams(window.location.search).get("sealKey");
+// 直播流名称和播放的文件, 通过页面地址 ?stream=xxx&file=xxx 传入, 为空时使用设备默认的流和文件
+var streamName = new URLSearchParams(window.location.search).get("stream") || undefined;
+var fileID = new URLSearchParams(window.location.search).get("file") || undefined;
+// 拉直播流时请求的画质 (low, mid, high) 和带宽 (kbps), ?quality=low&bandwidth=500
+var quality = new URLSearchParams(window.location.search).get("quality") || undefined;
+var bandwidth = parseInt(new URLSearchParams(window.location.search).get("bandwidth"), 10) || undefined;
+// 推流时使用 3 层 simulcast, ?simulcast=1
+var simulcast = new URLSearchParams(window.location.search).get("simulcast") === "1";
+// 信令服务, 默认连接 node 的 channel (socket.io), ?channel=ws 时用原生 WebSocket 连接 Go 的信令服务
+var plainChannel = new URLSearchParams(window.location.search).get("channel") === "ws";
+
+// connectRequest 和 clientgo/signal.ConnectRequest 相同, 参数只能用于对应的动作
+function connectRequest(action) {
+    var request = {action: action}
+    if (action === "push to file and stream" || action === "pull from stream") {
+        request.stream = streamName
+    } else if (action === "pull from file") {
+        request.file = fileID
+    }
+    if (action === "pull from stream") {
+        request.quality = quality
+        request.bandwidth = bandwidth
+    }
+    // 拉流时由设备生成 offer, 设备决定发送的 track 和编码
+    if (action === "pull from stream" || action === "pull from file") {
+        request.deviceOffer = true
+    }
+    return JSON.stringify(request)
+}
+
+// simulcastOffer 给第一个视频的 SSRC 加上两个 simulcast 层 (a=ssrc-group:SIM),
+// 设备只支持这种方式的 simulcast, 不支持 sendEncodings 的 rid 方式, 只对 Chrome 有效
+function simulcastOffer(sdp) {
+    var lines = sdp.split("\r\n")
+    var video = lines.findIndex(line => line.indexOf("m=video") === 0)
+    if (video < 0) {
+        return sdp
+    }
+    var ssrcLine = lines.slice(video).find(line => /^a=ssrc:\d+ /.test(line))
+    if (!ssrcLine) {
+        return sdp
+    }
+    var ssrc = ssrcLine.split(" ")[0].slice("a=ssrc:".length)
+    var own = lines.filter(line => line.indexOf("a=ssrc:" + ssrc + " ") === 0)
+    var layers = [ssrc, String(Math.floor(Math.random() * 0xffffffff)), String(Math.floor(Math.random() * 0xffffffff))]
+    var added = []
+    layers.slice(1).forEach(layer => {
+        own.forEach(line => added.push(line.replace("a=ssrc:" + ssrc + " ", "a=ssrc:" + layer + " ")))
+    })
+    added.push("a=ssrc-group:SIM " + layers.join(" "))
+    var last = lines.lastIndexOf(own[own.length - 1])
+    lines.splice(last + 1, 0, ...added)
+    return lines.join("\r\n")
+}
+
 class App extends Component {
+    // 每个设备当前连接发出的 candidate
+    candidates = {}
+
     state = {
         status: "正在链接 server  ... ",
         ready: false,
@@ -35,7 +100,7 @@ class App extends Component {
     handleIceCandidate(event, macAddr) {
         // console.log('icecandidate event: ', event);
         if (event.candidate) {
-            this.sendMessage({
+            var message = {
                 type: 'candidate',
                 sdpMid: event.candidate.sdpMid,
                 candidate: event.candidate.candidate,
@@ -43,17 +108,40 @@ class App extends Component {
                 usernameFragment: event.candidate.usernameFragment,
                 from: this.socket.id, // 本地链接的id
                 to: macAddr,// 要连接的盒子的mac地址
-            });
+            }
+            // 设备和信令服务断开时 candidate 不能送达, 收到 resume 后重新发送
+            this.candidates[macAddr] = [...(this.candidates[macAddr] || []), message]
+            this.sendMessage(message);
         } else {
             console.log('End of candidates.');
         }
     }
 
-    sendMessage(message) {
+    async sendMessage(message) {
+        message = {...message, token: token}
         console.log('Client sending message: ', message);
+        // sdp 为 JSON 字符串, 加密或者 base64 编码后发送
+        if (this.sealKey) {
+            if (message.sdp) {
+                message.sdp = await sealing.seal(this.sealKey, message.sdp, sealing.aad(message, "sdp"))
+            }
+            if (message.candidate) {
+                message.candidate = await sealing.seal(this.sealKey, message.candidate, sealing.aad(message, "candidate"))
+            }
+        } else if (message.sdp) {
+            message.sdp = btoa(message.sdp)
+        }
         this.socket.emit('messageToDevice', message);
     }
 
+    // 解密或者 base64 解码设备发来的 sdp
+    async readSdp(message) {
+        if (this.sealKey) {
+            return JSON.parse(await sealing.open(this.sealKey, message.sdp, sealing.aad(message, "sdp")))
+        }
+        return JSON.parse(atob(message.sdp))
+    }
+
 
     onTrack(event) {
         console.log("add stream")
@@ -67,8 +155,22 @@ class App extends Component {
 
 
     creatPeerConnection(macAddr) {
+        var pc = this.newPeerConnection(macAddr)
+        // 准备接收一路视频
+        // pc.addTransceiver('video', {'direction': 'recvonly'})
+        this.doCall(pc, macAddr)
+        this.setState({
+            pcs: {
+                ...this.state.pcs,
+                [macAddr]: pc
+            }
+        })
+    }
+
+    newPeerConnection(macAddr) {
         var pc = new RTCPeerConnection(pcConfig);
         var self = this;
+        this.candidates[macAddr] = []
 
         // 创建offer 准备发给盒子
         pc.onicecandidate = (e) => {
@@ -78,6 +180,17 @@ class App extends Component {
             // console.log(pc)
             // console.log(pc.iceConnectionState())
             document.querySelector("div#status").innerHTML += pc.iceConnectionState + "<br>"
+            if (pc.iceConnectionState === "connected" && self.pending === pc) {
+                self.replacePeerConnection(macAddr, pc)
+            }
+            if (pc.iceConnectionState === "failed" && self.state.pcs[macAddr] === pc) {
+                // 网络切换后连接失败, 设备通常会主动发送 ICE 重启的 offer, 没有收到时请求设备重启
+                setTimeout(() => {
+                    if (self.state.pcs[macAddr] === pc && !self.pending && pc.iceConnectionState === "failed") {
+                        self.renegotiate({iceRestart: true})
+                    }
+                }, 5000)
+            }
         };
         if (this.state.action !== "push to file and stream" && this.state.action !== "push to rtmp") {
             pc.ontrack = this.onTrack.bind(this);
@@ -85,24 +198,74 @@ class App extends Component {
         if (this.state.localStream) {
             pc.addStream(this.state.localStream)
         }
-        // 准备接收一路视频
-        // pc.addTransceiver('video', {'direction': 'recvonly'})
-        this.doCall(pc, macAddr)
+        return pc
+    }
+
+    // 重新协商: 设备每次协商都使用新的连接, 新的连接建立后关闭旧的连接
+    replacePeerConnection(macAddr, pc) {
+        var old = this.state.pcs[macAddr]
+        this.pending = null
         this.setState({
             pcs: {
                 ...this.state.pcs,
                 [macAddr]: pc
             }
         })
+        if (old && old !== pc) {
+            old.close()
+        }
+    }
+
+    // 设备发来的 offer, 用新的连接回复 answer
+    async acceptOffer(message) {
+        var macAddr = message.from
+        var pc = this.newPeerConnection(macAddr)
+        this.pending = pc
+        const offer = await this.readSdp(message)
+        await pc.setRemoteDescription(new RTCSessionDescription(offer))
+        const answer = await pc.createAnswer()
+        await pc.setLocalDescription(answer)
+        this.sendMessage({
+            from: this.socket.id,
+            to: macAddr,
+            sdp: JSON.stringify(answer),
+            type: "answer"
+        })
+    }
+
+    // 拉流会话切换为直播流或视频文件, 推流会话添加音频
+    renegotiate(change) {
+        this.sendMessage({
+            from: this.socket.id,
+            to: this.state.mac,
+            type: "renegotiate",
+            msg: JSON.stringify(change)
+        })
+    }
+
+    addAudio() {
+        var self = this
+        navigator.mediaDevices.getUserMedia({video: true, audio: true})
+            .then(stream => {
+                document.getElementById('video').srcObject = stream
+                self.setState({localStream: stream}, () => {
+                    var pc = self.newPeerConnection(self.state.mac)
+                    self.pending = pc
+                    self.doCall(pc, self.state.mac)
+                })
+            })
     }
 
     doCall(pc, macAddr) {
         pc.createOffer({offerToReceiveVideo: true}).then((sdp) => {
+            if (simulcast && this.state.localStream) {
+                sdp = {type: sdp.type, sdp: simulcastOffer(sdp.sdp)}
+            }
             pc.setLocalDescription(sdp)
             this.sendMessage({
                 from: this.socket.id,
                 to: macAddr,
-                sdp: btoa(JSON.stringify(sdp)),
+                sdp: JSON.stringify(sdp),
                 type: "offer"
             })
         }).catch((err) => {
@@ -114,23 +277,62 @@ class App extends Component {
 
         var self = this;
 
-        this.socket = io('ws://127.0.0.1:10900');
+        this.socket = plainChannel ? new ChannelSocket('ws://127.0.0.1:10900/ws') : io('ws://127.0.0.1:10900');
         //
         this.socket.on('connect', function () {
             self.setState({status: "链接服务成功"})
             self.setState({ready: true})
         });
-        this.socket.on("messageToBrowser", function (message) {
+        this.socket.on("messageToBrowser", async function (message) {
             console.log("client recive message", message)
             if (message.type === "ready") { // 等待服务区发来ready 消息
-                self.creatPeerConnection(message.from)
+                if (sealMode === "ecdh") {
+                    self.sealKey = await sealing.sharedKey(self.keyPair, message.key)
+                }
+                if (message.sdp) {
+                    // ready 消息带有设备的 offer
+                    self.acceptOffer(message)
+                } else {
+                    self.creatPeerConnection(message.from)
+                }
             } else if (message.type === "answer") {
-                if (self.state.pcs[message.from]) {
-                    console.log("answer", JSON.parse(atob(message.sdp)))
-                    self.state.pcs[message.from].setRemoteDescription(new RTCSessionDescription(JSON.parse(atob(message.sdp))))
+                var pc = self.pending || self.state.pcs[message.from]
+                if (pc) {
+                    const answer = await self.readSdp(message)
+                    console.log("answer", answer)
+                    pc.setRemoteDescription(new RTCSessionDescription(answer))
+                }
+            } else if (message.type === "offer") {
+                self.acceptOffer(message)
+            } else if (message.type === "error" && message.code === "device_offline" && self.state.pcs[message.from]) {
+                // 会话中设备和信令服务断开, 媒体连接不受影响, 等待设备发送 resume
+                self.setState({status: "设备信令断开, 等待恢复..."})
+            } else if (message.type === "resume") {
+                // 设备重新连接信令服务, 重新发送断线期间可能丢失的 candidate
+                self.setState({status: "设备信令已恢复"})
+                for (const candidate of self.candidates[message.from] || []) {
+                    self.sendMessage(candidate)
                 }
+            } else if (message.type === "error" && message.code === "limit_exceeded") {
+                // 设备的连接数、推流端、拉流端或文件播放达到上限, 稍后重试
+                toastr.warning("设备繁忙, 请稍后重试: " + message.msg)
             } else if (message.type === "error") {
-                toastr.error(message.msg)
+                toastr.error(message.code ? message.code + ": " + message.msg : message.msg)
+            } else if (message.type === "bye") {
+                // 设备关闭了会话
+                toastr.warning(message.msg || "会话已关闭")
+                var closed = self.state.pcs[message.from]
+                if (closed) {
+                    closed.close()
+                }
+                if (self.pending) {
+                    self.pending.close()
+                    self.pending = null
+                }
+                self.setState({pcs: {...self.state.pcs, [message.from]: undefined}, stats: null})
+            } else if (message.type === "stats") {
+                // 设备定时发送的会话统计
+                self.setState({stats: JSON.parse(message.msg)})
             }
 
         })
@@ -146,12 +348,19 @@ class App extends Component {
         });
     }
 
-    startConnect(action) {
+    async startConnect(action) {
         var mac = prompt("请输入 mac : 123")
         if (mac !== null && mac.trim() !== "") {
             // 发送请求，是否可以连接上视频服务
             this.setState({mac: mac, action: action})
-            this.socket.emit("canConnect", {to: mac, from: this.socket.id,msg:action})
+            var key
+            if (sealMode === "psk") {
+                this.sealKey = await sealing.keyFromSecret(sealSecret)
+            } else if (sealMode === "ecdh") {
+                this.keyPair = await sealing.generateKeyPair()
+                key = this.keyPair.encoded
+            }
+            this.socket.emit("canConnect", {to: mac, from: this.socket.id, msg: connectRequest(action), token: token, key: key})
         } else {
             // alert("请输入服务器 mac 地址")
         }
@@ -207,13 +416,41 @@ class App extends Component {
                             <br/>
                         </div>
                     ): (
-                        <h1>
-                            {this.state.action}
-                        </h1>
+                        <div>
+                            <h1>
+                                {this.state.action}
+                            </h1>
+                            {
+                                this.state.action === "pull from stream" || this.state.action === "pull from file" ? (
+                                    <div>
+                                        <button onClick={() => this.renegotiate({replace: true, add: [{stream: streamName || this.state.mac}]})}> 切换为直播流</button>
+                                        <button onClick={() => this.renegotiate({replace: true, add: [{file: fileID || "test"}]})}> 切换为视频文件</button>
+                                    </div>
+                                ) : (
+                                    <button onClick={() => this.addAudio()}> 添加音频</button>
+                                )
+                            }
+                        </div>
                     )
                 }
 
                 <div id={"status"}> </div>
+                {
+                    this.state.stats ? (
+                        <div>
+                            <aside>{this.state.stats.iceState}</aside>
+                            {
+                                this.state.stats.tracks.map(t => (
+                                    <aside key={t.ssrc}>
+                                        {t.direction} {t.kind} {Math.round(t.bitrate / 1000)} kbps {t.frameRate.toFixed(1)} fps
+                                        丢包 {(t.fractionLost * 100).toFixed(1)}% 抖动 {Math.round(t.jitter * 1000)} ms
+                                        {t.rtt ? " RTT " + Math.round(t.rtt * 1000) + " ms" : ""}
+                                    </aside>
+                                ))
+                            }
+                        </div>
+                    ) : null
+                }
                 <div id={"remoteVideos"}>
                     <video id="video" width="400" height="300" autoPlay muted style={{margin: "auto"}}> </video>
                 </div>
@@ -0,0 +1,67 @@
+// ChannelSocket 连接 Go 实现的信令服务 (clientgo/channel), 接口和 socket.io-client 的 socket 相同:
+// id、on(event, handler)、emit(event, data, callback)。每条消息是一个 JSON {event, data, id, ack},
+// 连接断开后每秒重连, 和 socket.io 一样触发 disconnect 和 connect 事件
+export default class ChannelSocket {
+    constructor(url) {
+        this.url = url
+        this.id = undefined
+        this.handlers = {}
+        this.callbacks = {}
+        this.nextID = 1
+        this.open()
+    }
+
+    open() {
+        var self = this
+        this.ws = new WebSocket(this.url)
+        this.ws.onmessage = function (e) {
+            var frame = JSON.parse(e.data)
+            if (frame.ack) {
+                var callback = self.callbacks[frame.ack]
+                delete self.callbacks[frame.ack]
+                if (callback) {
+                    callback(frame.data)
+                }
+                return
+            }
+            if (frame.event === "connect") {
+                self.id = frame.data
+            }
+            var handler = self.handlers[frame.event]
+            if (handler) {
+                handler(frame.data)
+            }
+        }
+        this.ws.onerror = function (e) {
+            var handler = self.handlers["error"]
+            if (handler) {
+                handler(e)
+            }
+        }
+        this.ws.onclose = function () {
+            self.id = undefined
+            self.callbacks = {}
+            var handler = self.handlers["disconnect"]
+            if (handler) {
+                handler()
+            }
+            setTimeout(() => self.open(), 1000)
+        }
+    }
+
+    on(event, handler) {
+        this.handlers[event] = handler
+    }
+
+    emit(event, data, callback) {
+        if (this.ws.readyState !== WebSocket.OPEN) {
+            return
+        }
+        var frame = {event: event, data: data}
+        if (callback) {
+            frame.id = this.nextID++
+            this.callbacks[frame.id] = callback
+        }
+        this.ws.send(JSON.stringify(frame))
+    }
+}
@@ -0,0 +1,82 @@
+// 信令加密, 和 clientgo/signal/seal.go 相同:
+// HKDF-SHA256 派生 AES-256-GCM 密钥, 密文格式 sealed.v1.base64(nonce || ciphertext || tag)
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+const PREFIX = "sealed.v1.";
+const INFO = encoder.encode("webrtc-signal sealed payload v1");
+const CURVE = {name: "ECDH", namedCurve: "P-256"};
+
+function toBase64(bytes) {
+    return btoa(String.fromCharCode.apply(null, new Uint8Array(bytes)));
+}
+
+function fromBase64(str) {
+    return Uint8Array.from(atob(str), c => c.charCodeAt(0));
+}
+
+function concat(a, b) {
+    var out = new Uint8Array(a.length + b.length);
+    out.set(a);
+    out.set(b, a.length);
+    return out;
+}
+
+async function deriveKey(secret, salt) {
+    const base = await crypto.subtle.importKey("raw", secret, "HKDF", false, ["deriveKey"]);
+    return crypto.subtle.deriveKey(
+        {name: "HKDF", hash: "SHA-256", salt: salt, info: INFO},
+        base,
+        {name: "AES-GCM", length: 256},
+        false,
+        ["encrypt", "decrypt"]
+    );
+}
+
+// psk 模式, 由和设备共享的密钥派生
+export function keyFromSecret(secret) {
+    return deriveKey(encoder.encode(secret), new Uint8Array(0));
+}
+
+// ecdh 模式, 浏览器生成临时密钥, 公钥放在 canConnect 消息的 key 字段
+export async function generateKeyPair() {
+    const keyPair = await crypto.subtle.generateKey(CURVE, false, ["deriveBits"]);
+    const publicKey = new Uint8Array(await crypto.subtle.exportKey("raw", keyPair.publicKey));
+    return {keyPair: keyPair, publicKey: publicKey, encoded: toBase64(publicKey)};
+}
+
+// 由设备在 ready 消息中回复的公钥派生共享密钥, 浏览器是发起方, salt 为 浏览器公钥 || 设备公钥
+export async function sharedKey(own, devicePublicKey) {
+    const peer = fromBase64(devicePublicKey);
+    const peerKey = await crypto.subtle.importKey("raw", peer, CURVE, false, []);
+    const secret = await crypto.subtle.deriveBits({name: "ECDH", public: peerKey}, own.keyPair.privateKey, 256);
+    return deriveKey(secret, concat(own.publicKey, peer));
+}
+
+// 密文绑定消息的发送方, 接收方和类型, 和 signal.Message.AAD 相同
+export function aad(message, field) {
+    return encoder.encode([message.from, message.to, message.type, field].join("\n"));
+}
+
+export async function seal(key, text, additionalData) {
+    const nonce = crypto.getRandomValues(new Uint8Array(12));
+    const sealed = await crypto.subtle.encrypt(
+        {name: "AES-GCM", iv: nonce, additionalData: additionalData},
+        key,
+        encoder.encode(text)
+    );
+    return PREFIX + toBase64(concat(nonce, new Uint8Array(sealed)));
+}
+
+export async function open(key, envelope, additionalData) {
+    if (!envelope || envelope.indexOf(PREFIX) !== 0) {
+        throw new Error("payload is not sealed");
+    }
+    const sealed = fromBase64(envelope.slice(PREFIX.length));
+    const plain = await crypto.subtle.decrypt(
+        {name: "AES-GCM", iv: sealed.slice(0, 12), additionalData: additionalData},
+        key,
+        sealed.slice(12)
+    );
+    return decoder.decode(plain);
+}